@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -11,7 +11,6 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -25,6 +24,10 @@ type TodoClaims struct {
 	Username string   `json:"username"`
 	Name     string   `json:"name"`
 	Scope    []string `json:"scope"`
+	// IssuedAtNano is the issue time in Unix nanoseconds. iat only has whole
+	// seconds, too coarse to tell tokens issued just before a revocation
+	// from those issued right after it.
+	IssuedAtNano int64 `json:"iatn,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -33,58 +36,56 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 	lr := &LoginRequest{}
 	err := json.NewDecoder(r.Body).Decode(lr)
 	if err != nil {
-		log.Printf("could not decode login request: %s\n", err)
-		http.Error(w, "could not decode login request: "+err.Error(), http.StatusBadRequest)
+		writeError(w, r, badRequest("could not decode login request", err))
 		return
 	}
 
-	coll := client.Database(viper.GetString("mongo.db")).Collection("users")
-	user := &User{}
-	err = coll.FindOne(r.Context(), bson.M{"username": lr.Username}).Decode(user)
+	user, err := userStore.GetUserByUsername(r.Context(), lr.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		writeError(w, r, internalError("could not find user", err))
+		return
+	}
 	if err != nil {
 		log.Printf("could not find user: %s\n", err)
-		http.Error(w, "could not find user: "+err.Error(), http.StatusUnauthorized)
+		writeError(w, r, errInvalidCredentials)
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(lr.Password))
 	if err != nil {
 		log.Printf("could not compare passwords: %s\n", err)
-		http.Error(w, "could not compare passwords: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	token, err := createToken(user)
-	if err != nil {
-		log.Printf("could not create token: %s\n", err)
-		http.Error(w, "could not create token: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, errInvalidCredentials)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(map[string]string{"token": token})
-	if err != nil {
-		log.Printf("could not encode token: %s\n", err)
-		http.Error(w, "could not encode token: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	writeTokens(w, r, user, "")
 }
 
+// errInvalidCredentials doesn't say whether the username or the password
+// was wrong.
+var errInvalidCredentials = newError(http.StatusUnauthorized, codeInvalidCredentials, "invalid username or password")
+
 func createToken(user *User) (string, error) {
+	jti, err := newRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := &TodoClaims{
-		ID:       user.ID,
-		Username: user.Username,
-		Name:     user.Name,
-		Scope:    user.Scope,
+		ID:           user.ID,
+		Username:     user.Username,
+		Name:         user.Name,
+		Scope:        user.Scope,
+		IssuedAtNano: now.UnixNano(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 15)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(viper.GetDuration("token.access_ttl"))),
+			IssuedAt:  jwt.NewNumericDate(now),
 			Issuer:    "todose",
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	ss, err := token.SignedString(privKey)
+	ss, err := keyRing.Sign(token)
 	if err != nil {
 		log.Printf("could not sign token: %s\n", err)
 		return "", err
@@ -92,16 +93,56 @@ func createToken(user *User) (string, error) {
 	return ss, nil
 }
 
-func validUser(r *http.Request) bool {
-	claims, err := getTokenClaims(r)
-	if err != nil {
-		log.Printf("could not get token claims: %s\n", err)
-		return false
+// Scopes that can be granted to a user and are checked per route.
+const (
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	scopeUsersAdmin = "users:admin"
+	scopeTodosRead  = "todos:read"
+	scopeTodosWrite = "todos:write"
+	scopeTodosAdmin = "todos:admin"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// HasScope reports whether the token grants scope.
+func (c *TodoClaims) HasScope(scope string) bool {
+	for _, s := range c.Scope {
+		if s == scope {
+			return true
+		}
 	}
-	if claims == nil {
-		return false
+	return false
+}
+
+// requireScope wraps next so it is only called with a valid token that grants
+// every one of scopes. The token claims are stored in the request context.
+func requireScope(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := getTokenClaims(r)
+		if err != nil {
+			log.Printf("could not get token claims: %s\n", err)
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "a valid bearer token is required"))
+			return
+		}
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				log.Printf("user %s is missing scope %s\n", claims.ID, scope)
+				writeError(w, r, newError(http.StatusForbidden, codeMissingScope, "missing scope "+scope))
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next(w, r.WithContext(ctx))
 	}
-	return true
+}
+
+// claimsFromContext returns the claims stored by requireScope.
+func claimsFromContext(ctx context.Context) *TodoClaims {
+	claims, _ := ctx.Value(claimsContextKey).(*TodoClaims)
+	return claims
 }
 
 func getTokenClaims(r *http.Request) (*TodoClaims, error) {
@@ -111,13 +152,7 @@ func getTokenClaims(r *http.Request) (*TodoClaims, error) {
 	}
 	tokenString := strings.TrimPrefix(authorization, "Bearer ")
 	claims := &TodoClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodRSA)
-		if !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return pubKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyRing.Keyfunc)
 	if err != nil {
 		return nil, errors.New("invalid token: " + err.Error())
 	}
@@ -125,5 +160,13 @@ func getTokenClaims(r *http.Request) (*TodoClaims, error) {
 		return nil, errors.New("invalid token")
 	}
 
+	revoked, err := tokenStore.IsRevoked(r.Context(), claims)
+	if err != nil {
+		return nil, errors.New("could not check revocation: " + err.Error())
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+
 	return claims, nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRequireScope(t *testing.T) {
+	setupStores(t)
+	reader := &User{ID: "reader", Scope: []string{scopeUsersRead}}
+	createTestUser(t, &User{ID: "victim", Name: "Victim"})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		user   *User
+		code   int
+	}{
+		{"no token", "GET", "/api/v1/users", nil, 401},
+		{"read with scope", "GET", "/api/v1/users", reader, 200},
+		{"create without scope", "POST", "/api/v1/users", reader, 403},
+		{"update without scope", "PUT", "/api/v1/users/victim", reader, 403},
+		{"delete without scope", "DELETE", "/api/v1/users/victim", reader, 403},
+		{"todos without scope", "GET", "/api/v1/todos", reader, 403},
+		{"delete with scope", "DELETE", "/api/v1/users/victim", testAdmin, 204},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(t, tt.user, tt.method, tt.path, `{"name":"Mallory"}`)
+			if w.Code != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, w.Code)
+			}
+		})
+	}
+}
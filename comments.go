@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Comment is a note on a todo, in markdown. AuthorID is the user who wrote
+// it and Mentions the IDs of the users it mentions as @username. History
+// holds the bodies it had before it was edited, oldest first. Author is
+// filled in on responses that ask for ?expand=author.
+type Comment struct {
+	ID        string            `json:"id" bson:"_id"`
+	TodoID    string            `json:"todoId" bson:"todoId"`
+	AuthorID  string            `json:"authorId" bson:"authorId"`
+	Author    *UserSummary      `json:"author,omitempty" bson:"-"`
+	Body      string            `json:"body" bson:"body" validate:"required,max=10000"`
+	Mentions  []string          `json:"mentions" bson:"mentions"`
+	History   []CommentRevision `json:"history,omitempty" bson:"history,omitempty"`
+	CreatedAt time.Time         `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt" bson:"updatedAt"`
+	Version   int64             `json:"version" bson:"version"`
+}
+
+// CommentRevision is a body a comment had until EditedBy replaced it at
+// EditedAt.
+type CommentRevision struct {
+	Body     string    `json:"body" bson:"body"`
+	EditedAt time.Time `json:"editedAt" bson:"editedAt"`
+	EditedBy string    `json:"editedBy" bson:"editedBy"`
+}
+
+// maxCommentHistory bounds the revisions kept per comment; older ones are
+// dropped.
+const maxCommentHistory = 50
+
+// maxMentions bounds the users a comment can mention.
+const maxMentions = 20
+
+// mentionPattern finds @username mentions. They must not follow a word
+// character, so email addresses don't count.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([a-zA-Z0-9][a-zA-Z0-9._-]*)`)
+
+// codePattern finds markdown code blocks and spans, where @ mentions nobody.
+var codePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+
+// resolveMentions returns the IDs of the users body mentions who can read
+// todo, in the order they are first mentioned. Other names are left as
+// text whether they are users or not, so mentions don't reveal who has an
+// account.
+func resolveMentions(ctx context.Context, todo *Todo, body string) ([]string, error) {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(codePattern.ReplaceAllString(body, " "), -1) {
+		username := strings.ToLower(match[1])
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		if len(seen) > maxMentions {
+			break
+		}
+		user, err := mentionedUser(ctx, todo, username)
+		// A sentence may end right after a mention, so trailing dots only
+		// belong to the name if that is who can be mentioned.
+		if err == nil && user == nil && strings.HasSuffix(username, ".") {
+			user, err = mentionedUser(ctx, todo, strings.TrimRight(username, "."))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && !containsString(ids, user.ID) {
+			ids = append(ids, user.ID)
+		}
+	}
+	return ids, nil
+}
+
+// mentionedUser returns the user named username if they can read todo, and
+// nil otherwise.
+func mentionedUser(ctx context.Context, todo *Todo, username string) (*User, error) {
+	user, err := userStore.GetUserByUsername(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	claims := &TodoClaims{ID: user.ID, Scope: user.Scope}
+	if !claims.HasScope(scopeTodosRead) || !canAccessTodo(claims, todo) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// expandAuthors fills in Author on comments if the request asks for
+// ?expand=author. Authors that no longer exist are left empty.
+func expandAuthors(r *http.Request, comments ...*Comment) {
+	if r.URL.Query().Get("expand") != "author" {
+		return
+	}
+	authors := map[string]*UserSummary{}
+	for _, comment := range comments {
+		author, ok := authors[comment.AuthorID]
+		if !ok {
+			user, err := userStore.GetUser(r.Context(), comment.AuthorID)
+			if err == nil {
+				author = newUserSummary(user)
+			}
+			authors[comment.AuthorID] = author
+		}
+		comment.Author = author
+	}
+}
+
+// getAccessibleComment loads the todo and the comment named in the URL and
+// checks the caller may access the todo. It writes the error response and
+// returns a nil comment if not.
+func getAccessibleComment(w http.ResponseWriter, r *http.Request) (*Todo, *Comment) {
+	todo := getAccessibleTodo(w, r)
+	if todo == nil {
+		return nil, nil
+	}
+	commentID := mux.Vars(r)["commentID"]
+	comment, err := commentStore.GetComment(r.Context(), commentID)
+	if err == nil && comment.TodoID != todo.ID {
+		err = ErrCommentNotFound
+	}
+	if err != nil {
+		writeError(w, r, storeError("could not find comment", err))
+		return nil, nil
+	}
+	return todo, comment
+}
+
+// getComments lists the comments on a todo, oldest first.
+func getComments(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting comments...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil {
+		return
+	}
+	comments, err := commentStore.ListComments(r.Context(), todo.ID)
+	if err != nil {
+		writeError(w, r, internalError("could not find comments", err))
+		return
+	}
+	expandAuthors(r, comments...)
+	writeJSON(w, r, http.StatusOK, comments)
+}
+
+func getComment(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting comment...")
+	_, comment := getAccessibleComment(w, r)
+	if comment == nil || notModified(w, r, comment.Version) {
+		return
+	}
+	expandAuthors(r, comment)
+	writeJSON(w, r, http.StatusOK, comment)
+}
+
+// createComment adds a comment to a todo, written by the caller.
+func createComment(w http.ResponseWriter, r *http.Request) {
+	log.Println("Creating comment...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil {
+		return
+	}
+	comment := &Comment{}
+	err := json.NewDecoder(r.Body).Decode(comment)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode comment", err))
+		return
+	}
+	comment.Body = strings.TrimSpace(comment.Body)
+	if !checkValid(w, r, comment) {
+		return
+	}
+	comment.Mentions, err = resolveMentions(r.Context(), todo, comment.Body)
+	if err != nil {
+		writeError(w, r, internalError("could not resolve mentions", err))
+		return
+	}
+	comment.ID, err = newID()
+	if err != nil {
+		writeError(w, r, internalError("could not generate id", err))
+		return
+	}
+	comment.TodoID = todo.ID
+	comment.AuthorID = claimsFromContext(r.Context()).ID
+	comment.Author = nil
+	comment.History = nil
+	comment.CreatedAt = currentTime()
+	comment.UpdatedAt = comment.CreatedAt
+	comment.Version = 1
+	err = commentStore.CreateComment(r.Context(), comment)
+	if err != nil {
+		writeError(w, r, storeError("could not create comment", err))
+		return
+	}
+	w.Header().Set("Location", "/api/v1/todos/"+todo.ID+"/comments/"+comment.ID)
+	w.Header().Set("ETag", etag(comment.Version))
+	writeJSON(w, r, http.StatusCreated, comment)
+}
+
+// updateComment replaces the body of a comment, keeping the old one in its
+// history. Only the author may edit a comment; resending the same body
+// changes nothing.
+func updateComment(w http.ResponseWriter, r *http.Request) {
+	log.Println("Updating comment...")
+	todo, comment := getAccessibleComment(w, r)
+	if comment == nil || !checkIfMatch(w, r, comment.Version) {
+		return
+	}
+	claims := claimsFromContext(r.Context())
+	if comment.AuthorID != claims.ID {
+		log.Printf("user %s cannot edit comment %s\n", claims.ID, comment.ID)
+		writeError(w, r, forbidden("only the author can edit comment "+comment.ID))
+		return
+	}
+	edit := &Comment{}
+	err := json.NewDecoder(r.Body).Decode(edit)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode comment", err))
+		return
+	}
+	edit.Body = strings.TrimSpace(edit.Body)
+	if !checkValid(w, r, edit) {
+		return
+	}
+	if edit.Body != comment.Body {
+		comment.Mentions, err = resolveMentions(r.Context(), todo, edit.Body)
+		if err != nil {
+			writeError(w, r, internalError("could not resolve mentions", err))
+			return
+		}
+		now := currentTime()
+		comment.History = append(comment.History, CommentRevision{Body: comment.Body, EditedAt: now, EditedBy: claims.ID})
+		if len(comment.History) > maxCommentHistory {
+			comment.History = comment.History[len(comment.History)-maxCommentHistory:]
+		}
+		comment.Body = edit.Body
+		comment.UpdatedAt = now
+		err = commentStore.UpdateComment(r.Context(), comment.ID, comment)
+		if err != nil {
+			writeError(w, r, storeError("could not update comment", err))
+			return
+		}
+	}
+	w.Header().Set("ETag", etag(comment.Version))
+	writeJSON(w, r, http.StatusOK, comment)
+}
+
+// deleteComment deletes a comment. Besides its author, admins of todos may
+// delete it.
+func deleteComment(w http.ResponseWriter, r *http.Request) {
+	log.Println("Deleting comment...")
+	_, comment := getAccessibleComment(w, r)
+	if comment == nil || !checkIfMatch(w, r, comment.Version) {
+		return
+	}
+	claims := claimsFromContext(r.Context())
+	if comment.AuthorID != claims.ID && !claims.HasScope(scopeTodosAdmin) {
+		log.Printf("user %s cannot delete comment %s\n", claims.ID, comment.ID)
+		writeError(w, r, forbidden("only the author can delete comment "+comment.ID))
+		return
+	}
+	err := commentStore.DeleteComment(r.Context(), comment.ID, comment.Version)
+	if err != nil {
+		writeError(w, r, storeError("could not delete comment", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestComments(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	bob := &User{ID: "bob", Username: "bob", Name: "Bob", Scope: []string{scopeTodosRead, scopeTodosWrite}}
+	createTestUser(t, testAdmin)
+	createTestUser(t, bob)
+	carol := &User{ID: "carol", Username: "carol", Scope: []string{scopeTodosRead, scopeTodosAdmin}}
+	createTestUser(t, carol)
+	createTestUser(t, &User{ID: "dan", Username: "dan", Scope: []string{scopeTodosRead}})
+	createTestUser(t, &User{ID: "jo", Username: "jo.", Scope: []string{scopeTodosRead, scopeTodosAdmin}})
+	todoStore.CreateTodo(ctx, &Todo{ID: "chores", Title: "Chores", OwnerID: "bob", Version: 1})
+	todoStore.CreateTodo(ctx, &Todo{ID: "other", Title: "Other", OwnerID: "bob", Version: 1})
+
+	body := "Can @Admin and @carol. check?\n\nMail bob@example.com, not `@bob` or @ghost\n```\n@bob\n```"
+	w := send(t, bob, "POST", "/api/v1/todos/chores/comments", `{"body":`+quote(body)+`,"authorId":"carol"}`)
+	bobs := &Comment{}
+	json.NewDecoder(w.Body).Decode(bobs)
+	if w.Code != 201 || bobs.AuthorID != "bob" || strings.Join(bobs.Mentions, ",") != "testadmin,carol" {
+		t.Fatalf("Expected a comment by bob mentioning admin and carol, got %d: %+v", w.Code, bobs)
+	}
+	admins := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos/chores/comments", `{"body":"On it"}`))
+	if w := send(t, bob, "POST", "/api/v1/todos/chores/comments", `{"body":"  "}`); w.Code != 422 {
+		t.Errorf("Expected status code 422, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Users who can't read the todo are left as text like names that aren't
+	// users, and a trailing dot only belongs to names that have one
+	w = send(t, bob, "POST", "/api/v1/todos/chores/comments", `{"body":"Thoughts, @dan, @ghost, @jo. or @carol.?"}`)
+	mentioning := &Comment{}
+	json.NewDecoder(w.Body).Decode(mentioning)
+	if w.Code != 201 || strings.Join(mentioning.Mentions, ",") != "jo,carol" {
+		t.Errorf("Expected a comment mentioning jo and carol, got %d: %+v", w.Code, mentioning)
+	}
+	send(t, bob, "DELETE", "/api/v1/todos/chores/comments/"+mentioning.ID, "")
+	if w := send(t, carol, "GET", "/api/v1/todos/chores/comments/"+bobs.ID, ""); w.Code != 200 {
+		t.Errorf("Expected the mentioned user to read the comment, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = send(t, bob, "GET", "/api/v1/todos/chores/comments?expand=author", "")
+	comments := []*Comment{}
+	json.NewDecoder(w.Body).Decode(&comments)
+	if len(comments) != 2 || comments[0].ID != bobs.ID || comments[1].Author == nil || comments[1].Author.Username != "admin" {
+		t.Errorf("Expected both comments oldest first with authors, got %+v", comments)
+	}
+	if w := send(t, bob, "GET", "/api/v1/todos/other/comments/"+admins, ""); w.Code != 404 || decodeProblem(t, w).Code != codeCommentNotFound {
+		t.Errorf("Expected status code 404, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Only the author edits a comment, and edits keep the old body
+	if w := send(t, bob, "PUT", "/api/v1/todos/chores/comments/"+admins, `{"body":"Not me"}`); w.Code != 403 {
+		t.Errorf("Expected status code 403, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send(t, testAdmin, "PUT", "/api/v1/todos/chores/comments/"+admins, `{"body":"On it, @bob"}`)
+	edited := &Comment{}
+	json.NewDecoder(w.Body).Decode(edited)
+	if w.Code != 200 || edited.Version != 2 || len(edited.History) != 1 || edited.History[0].Body != "On it" || strings.Join(edited.Mentions, ",") != "bob" {
+		t.Errorf("Expected the edit to be recorded, got %d: %+v", w.Code, edited)
+	}
+	w = send(t, testAdmin, "PUT", "/api/v1/todos/chores/comments/"+admins, `{"body":" On it, @bob "}`)
+	unchanged := &Comment{}
+	json.NewDecoder(w.Body).Decode(unchanged)
+	if w.Code != 200 || unchanged.Version != 2 || len(unchanged.History) != 1 {
+		t.Errorf("Expected resending the body to change nothing, got %d: %+v", w.Code, unchanged)
+	}
+
+	// Authors and todo admins delete comments
+	if w := send(t, bob, "DELETE", "/api/v1/todos/chores/comments/"+admins, ""); w.Code != 403 {
+		t.Errorf("Expected status code 403, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "DELETE", "/api/v1/todos/chores/comments/"+bobs.ID, ""); w.Code != 204 {
+		t.Errorf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Comments go with their todo
+	if w := send(t, bob, "DELETE", "/api/v1/todos/chores", ""); w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if comments, _ := commentStore.ListComments(ctx, "chores"); len(comments) != 0 {
+		t.Errorf("Expected the comments to be deleted, got %+v", comments)
+	}
+}
+
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// encodeCursor turns the position after the last item of a page into an
+// opaque cursor string.
+func encodeCursor(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// parseLimit reads ?limit, defaulting to defaultPageSize and capped at
+// maxPageSize.
+func parseLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 {
+		return 0, strconv.ErrSyntax
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// setNextPage advertises the next page through a Link header (RFC 8288) and
+// X-Next-Cursor. The link repeats the request's query with the new cursor.
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	next := *r.URL
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", `<`+next.RequestURI()+`>; rel="next"`)
+	w.Header().Set("X-Next-Cursor", cursor)
+}
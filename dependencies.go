@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// maxGraphNodes bounds the size of a dependency graph response.
+const maxGraphNodes = 500
+
+// checkBlockers writes a 422 response and returns false if todo can't be
+// blocked by the todos in its BlockedBy, which are deduplicated first. They
+// must exist and belong to the same owner, and must not depend on todo
+// themselves, which would make a cycle.
+func checkBlockers(w http.ResponseWriter, r *http.Request, todo *Todo) bool {
+	invalid := func(code, message string) bool {
+		writeError(w, r, validationFailed(FieldError{Field: "blockedBy", Code: code, Message: message}))
+		return false
+	}
+	blockers := []string{}
+	for _, id := range todo.BlockedBy {
+		if id != "" && !containsString(blockers, id) {
+			blockers = append(blockers, id)
+		}
+	}
+	todo.BlockedBy = blockers
+
+	for _, id := range blockers {
+		if id == todo.ID {
+			return invalid("cycle", "a todo cannot block itself")
+		}
+		blocker, err := todoStore.GetTodo(r.Context(), id)
+		if errors.Is(err, ErrTodoNotFound) || (err == nil && blocker.OwnerID != todo.OwnerID) {
+			return invalid("blocker_not_found", "todo "+id+" does not exist or belongs to another owner")
+		}
+		if err != nil {
+			writeError(w, r, internalError("could not find blocker", err))
+			return false
+		}
+	}
+	if todo.ID == "" {
+		return true
+	}
+	path, err := blockingPath(r.Context(), blockers, todo.ID)
+	if err != nil {
+		writeError(w, r, internalError("could not check for cycles", err))
+		return false
+	}
+	if path != nil {
+		return invalid("cycle", "todo would block itself through "+strings.Join(path, " -> "))
+	}
+	return true
+}
+
+// blockingPath looks for target among the blockers of from, their blockers
+// and so on. It returns the chain of blockers leading from one of from to
+// target, or nil if there is none.
+func blockingPath(ctx context.Context, from []string, target string) ([]string, error) {
+	next := map[string]string{}
+	queue := []string{}
+	for _, id := range from {
+		next[id] = ""
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == target {
+			path := []string{}
+			for ; id != ""; id = next[id] {
+				path = append([]string{id}, path...)
+			}
+			return path, nil
+		}
+		todo, err := todoStore.GetTodo(ctx, id)
+		if errors.Is(err, ErrTodoNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, blocker := range todo.BlockedBy {
+			if _, seen := next[blocker]; !seen {
+				next[blocker] = id
+				queue = append(queue, blocker)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// checkUnblocked runs before todo is stored as done. Open blockers keep it
+// from being completed unless the request has ?force=true. It writes the
+// error response and returns false if todo can't be completed.
+func checkUnblocked(w http.ResponseWriter, r *http.Request, todo *Todo) bool {
+	if r.URL.Query().Get("force") == "true" {
+		return true
+	}
+	open, err := openBlockers(r.Context(), todo)
+	if err != nil {
+		writeError(w, r, internalError("could not find blocker", err))
+		return false
+	}
+	if len(open) > 0 {
+		writeError(w, r, newError(http.StatusConflict, codeBlocked, "todo is blocked by open todos "+strings.Join(open, ", ")+", complete with ?force=true to override"))
+		return false
+	}
+	return true
+}
+
+// openBlockers returns the IDs of the todos blocking todo that aren't done.
+// Blockers deleted since don't count.
+func openBlockers(ctx context.Context, todo *Todo) ([]string, error) {
+	open := []string{}
+	for _, id := range todo.BlockedBy {
+		blocker, err := todoStore.GetTodo(ctx, id)
+		if errors.Is(err, ErrTodoNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if blocker.CompletedAt == nil {
+			open = append(open, id)
+		}
+	}
+	return open, nil
+}
+
+// GraphNode is a todo in a dependency graph.
+type GraphNode struct {
+	ID     string     `json:"id"`
+	Title  string     `json:"title"`
+	Status TodoStatus `json:"status"`
+	Done   bool       `json:"done"`
+}
+
+// GraphEdge says that the todo From blocks the todo To.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DependencyGraph is the todos Root depends on and the todos that depend on
+// Root, directly or not. Nodes are in topological order, blockers before the
+// todos they block. Truncated is set if the graph was cut off at
+// maxGraphNodes.
+type DependencyGraph struct {
+	Root      string      `json:"root"`
+	Nodes     []GraphNode `json:"nodes"`
+	Edges     []GraphEdge `json:"edges"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// dependencyGraph walks the blockers and the dependents of root.
+func dependencyGraph(ctx context.Context, root *Todo) (*DependencyGraph, error) {
+	graph := &DependencyGraph{Root: root.ID, Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	todos := map[string]*Todo{root.ID: root}
+
+	// Walk up the blockers, then down the dependents, so the graph holds
+	// what root waits for and what waits for root but nothing beside.
+	for _, up := range []bool{true, false} {
+		queue := []*Todo{root}
+		for len(queue) > 0 && !graph.Truncated {
+			todo := queue[0]
+			queue = queue[1:]
+			var related []*Todo
+			if up {
+				for _, id := range todo.BlockedBy {
+					blocker, err := todoStore.GetTodo(ctx, id)
+					if errors.Is(err, ErrTodoNotFound) {
+						continue
+					}
+					if err != nil {
+						return nil, err
+					}
+					related = append(related, blocker)
+				}
+			} else {
+				dependents, err := todoStore.ListTodos(ctx, TodoFilter{BlockedBy: todo.ID})
+				if err != nil {
+					return nil, err
+				}
+				related = dependents
+			}
+			for _, t := range related {
+				if _, seen := todos[t.ID]; seen {
+					continue
+				}
+				if len(todos) == maxGraphNodes {
+					graph.Truncated = true
+					break
+				}
+				todos[t.ID] = t
+				queue = append(queue, t)
+			}
+		}
+	}
+
+	// Kahn's algorithm, taking ready todos in ID order so the result is
+	// stable.
+	waiting := map[string]int{}
+	blocks := map[string][]string{}
+	for id, todo := range todos {
+		for _, blocker := range todo.BlockedBy {
+			if _, ok := todos[blocker]; ok {
+				graph.Edges = append(graph.Edges, GraphEdge{From: blocker, To: id})
+				waiting[id]++
+				blocks[blocker] = append(blocks[blocker], id)
+			}
+		}
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+	ready := []string{}
+	for id := range todos {
+		if waiting[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		id := ready[0]
+		ready = ready[1:]
+		todo := todos[id]
+		graph.Nodes = append(graph.Nodes, GraphNode{ID: id, Title: todo.Title, Status: todo.Status, Done: todo.CompletedAt != nil})
+		for _, next := range blocks[id] {
+			waiting[next]--
+			if waiting[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	if len(graph.Nodes) != len(todos) {
+		// Only concurrent writes can sneak a cycle past checkBlockers.
+		return nil, fmt.Errorf("dependencies of todo %s have a cycle", root.ID)
+	}
+	return graph, nil
+}
+
+// getTodoGraph returns the dependency graph around a todo.
+func getTodoGraph(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting todo graph...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil {
+		return
+	}
+	graph, err := dependencyGraph(r.Context(), todo)
+	if err != nil {
+		writeError(w, r, internalError("could not build dependency graph", err))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, graph)
+}
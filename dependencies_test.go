@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestTodoDependencies(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	createTestUser(t, &User{ID: "bob", Username: "bob"})
+	design := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Design"}`))
+	build := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Build","blockedBy":["`+design+`","`+design+`"]}`))
+	test := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Test","blockedBy":["`+build+`"]}`))
+	ship := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Ship","blockedBy":["`+test+`","`+build+`"]}`))
+	if todo, _ := todoStore.GetTodo(ctx, build); len(todo.BlockedBy) != 1 {
+		t.Errorf("Expected duplicate blockers to be dropped, got %v", todo.BlockedBy)
+	}
+
+	// Links must point at existing todos of the same owner and never loop
+	todoStore.CreateTodo(ctx, &Todo{ID: "bobs", Title: "Bob's", OwnerID: "bob"})
+	invalid := []struct{ target, body, code string }{
+		{"/api/v1/todos/" + design, `{"blockedBy":["` + ship + `"]}`, "cycle"},
+		{"/api/v1/todos/" + design, `{"blockedBy":["` + design + `"]}`, "cycle"},
+		{"/api/v1/todos/" + design, `{"blockedBy":["missing"]}`, "blocker_not_found"},
+		{"/api/v1/todos/" + design, `{"blockedBy":["bobs"]}`, "blocker_not_found"},
+	}
+	for _, tt := range invalid {
+		w := send(t, testAdmin, "PATCH", tt.target, tt.body)
+		if w.Code != 422 {
+			t.Errorf("%s %s: expected status code 422, got %d: %s", tt.target, tt.body, w.Code, w.Body.String())
+			continue
+		}
+		if problem := decodeProblem(t, w); len(problem.Errors) != 1 || problem.Errors[0].Code != tt.code {
+			t.Errorf("%s %s: expected %s, got %+v", tt.target, tt.body, tt.code, problem.Errors)
+		}
+	}
+
+	// The graph runs from what a todo waits for to what waits for it
+	w := send(t, testAdmin, "GET", "/api/v1/todos/"+test+"/graph", "")
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	graph := &DependencyGraph{}
+	json.NewDecoder(w.Body).Decode(graph)
+	order := ""
+	for _, node := range graph.Nodes {
+		order += node.Title + " "
+	}
+	if order != "Design Build Test Ship " || len(graph.Edges) != 4 || graph.Root != test {
+		t.Errorf("Expected a topologically sorted graph, got %s with %+v", order, graph.Edges)
+	}
+
+	// Blocked todos can't be completed unless forced
+	w = send(t, testAdmin, "PATCH", "/api/v1/todos/"+build, `{"status":"done"}`)
+	if w.Code != 409 || decodeProblem(t, w).Code != codeBlocked {
+		t.Errorf("Expected status code 409, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+build+"/transitions", `{"to":"done"}`); w.Code != 409 {
+		t.Errorf("Expected status code 409, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+design+"/transitions", `{"to":"done"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "PATCH", "/api/v1/todos/"+build, `{"status":"done"}`); w.Code != 200 {
+		t.Errorf("Expected an unblocked todo to complete, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "PATCH", "/api/v1/todos/"+ship+"?force=true", `{"status":"done"}`); w.Code != 200 {
+		t.Errorf("Expected a forced completion to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Deleting a todo unblocks its dependents
+	if w := send(t, testAdmin, "DELETE", "/api/v1/todos/"+test, ""); w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if todo, _ := todoStore.GetTodo(ctx, ship); len(todo.BlockedBy) != 1 || todo.BlockedBy[0] != build {
+		t.Errorf("Expected the deleted todo to be unlinked, got %v", todo.BlockedBy)
+	}
+}
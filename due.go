@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	// Due dates are grouped by day in the client's time zone, so the zone
+	// database is embedded rather than relying on the host's.
+	_ "time/tzdata"
+)
+
+var locations sync.Map
+
+// loadLocation returns the IANA time zone name, caching zones already
+// loaded. "Local" is refused because it depends on the server.
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	if name == "" || name == "Local" {
+		return nil, errors.New("unknown time zone " + name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New("unknown time zone " + name)
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// MarshalJSON renders dueAt, remindAt and the recurrence times in the
+// todo's time zone, so clients get back the local time they set even though
+// the stores keep UTC.
+func (t Todo) MarshalJSON() ([]byte, error) {
+	type plain Todo
+	p := plain(t)
+	if loc, err := loadLocation(t.TimeZone); err == nil {
+		p.DueAt = inLocation(t.DueAt, loc)
+		p.RemindAt = inLocation(t.RemindAt, loc)
+		if t.Recurrence != nil {
+			rec := *t.Recurrence
+			rec.Start = rec.Start.In(loc)
+			rec.At = rec.At.In(loc)
+			p.Recurrence = &rec
+		}
+	}
+	return json.Marshal(p)
+}
+
+func inLocation(t *time.Time, loc *time.Location) *time.Time {
+	if t == nil {
+		return nil
+	}
+	local := t.In(loc)
+	return &local
+}
+
+// checkDueDates returns the violations validate can't see because they
+// involve more than one field, the recurrence rule included.
+func checkDueDates(todo *Todo) []FieldError {
+	if todo.DueAt != nil && todo.RemindAt != nil && todo.RemindAt.After(*todo.DueAt) {
+		return []FieldError{{Field: "remindAt", Code: "after_due", Message: "must not be after dueAt"}}
+	}
+	return checkRecurrence(todo)
+}
+
+// normalizeDueDates stores due dates in UTC at the precision of currentTime.
+func normalizeDueDates(todo *Todo) {
+	for _, t := range []**time.Time{&todo.DueAt, &todo.RemindAt} {
+		if *t != nil {
+			utc := (*t).UTC().Truncate(time.Millisecond)
+			*t = &utc
+		}
+	}
+}
+
+// Upcoming is the caller's incomplete todos grouped by the day they are due
+// in TimeZone. ThisWeek runs from the day after tomorrow until the end of
+// the week, which ends on Sunday.
+type Upcoming struct {
+	TimeZone string  `json:"timeZone"`
+	Today    []*Todo `json:"today"`
+	Tomorrow []*Todo `json:"tomorrow"`
+	ThisWeek []*Todo `json:"thisWeek"`
+}
+
+// upcomingBounds returns the start of today, tomorrow and the day after,
+// and the end of the week, as of now in now's location. Days are computed
+// by calendar so they stay correct across daylight saving changes.
+func upcomingBounds(now time.Time) (today, tomorrow, dayAfter, weekEnd time.Time) {
+	today = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	tomorrow = today.AddDate(0, 0, 1)
+	dayAfter = today.AddDate(0, 0, 2)
+	daysSinceMonday := (int(today.Weekday()) + 6) % 7
+	weekEnd = today.AddDate(0, 0, 7-daysSinceMonday)
+	return today, tomorrow, dayAfter, weekEnd
+}
+
+// getUpcomingTodos answers GET /api/v1/todos/upcoming. Days are reckoned in
+// the IANA time zone given by ?tz, UTC by default.
+func getUpcomingTodos(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting upcoming todos...")
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := loadLocation(tz)
+	if err != nil {
+		writeError(w, r, badRequest(err.Error(), nil))
+		return
+	}
+	today, tomorrow, dayAfter, weekEnd := upcomingBounds(time.Now().In(loc))
+	end := weekEnd
+	if end.Before(dayAfter) {
+		end = dayAfter
+	}
+
+	filter := TodoFilter{
+		OwnerID:    claimsFromContext(r.Context()).ID,
+		DueAfter:   today,
+		DueBefore:  end,
+		Incomplete: true,
+	}
+	todos, err := todoStore.ListTodos(r.Context(), filter)
+	if err != nil {
+		writeError(w, r, internalError("could not find todos", err))
+		return
+	}
+	sort.SliceStable(todos, func(i, j int) bool { return todos[i].DueAt.Before(*todos[j].DueAt) })
+	expandOwners(r, todos...)
+
+	upcoming := &Upcoming{TimeZone: loc.String(), Today: []*Todo{}, Tomorrow: []*Todo{}, ThisWeek: []*Todo{}}
+	for _, todo := range todos {
+		switch {
+		case todo.DueAt.Before(tomorrow):
+			upcoming.Today = append(upcoming.Today, todo)
+		case todo.DueAt.Before(dayAfter):
+			upcoming.Tomorrow = append(upcoming.Tomorrow, todo)
+		default:
+			upcoming.ThisWeek = append(upcoming.ThisWeek, todo)
+		}
+	}
+	writeJSON(w, r, http.StatusOK, upcoming)
+}
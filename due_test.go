@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUpcomingBounds(t *testing.T) {
+	berlin, err := loadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Error loading time zone: %s\n", err)
+	}
+
+	// Clocks go forward on Sunday, March 29, 2026 in Berlin.
+	today, tomorrow, dayAfter, weekEnd := upcomingBounds(time.Date(2026, 3, 28, 22, 30, 0, 0, berlin))
+	if today.Format(time.RFC3339) != "2026-03-28T00:00:00+01:00" {
+		t.Errorf("Expected today to start at midnight, got %s", today)
+	}
+	if tomorrow.Format(time.RFC3339) != "2026-03-29T00:00:00+01:00" || dayAfter.Format(time.RFC3339) != "2026-03-30T00:00:00+02:00" {
+		t.Errorf("Expected calendar days across the DST change, got %s and %s", tomorrow, dayAfter)
+	}
+	if dayAfter.Sub(tomorrow) != 23*time.Hour {
+		t.Errorf("Expected a 23 hour Sunday, got %s", dayAfter.Sub(tomorrow))
+	}
+	if !weekEnd.Equal(dayAfter) {
+		t.Errorf("Expected the week to end on Monday, got %s", weekEnd)
+	}
+
+	_, _, _, weekEnd = upcomingBounds(time.Date(2026, 10, 21, 8, 0, 0, 0, berlin))
+	if weekEnd.Format(time.RFC3339) != "2026-10-26T00:00:00+01:00" {
+		t.Errorf("Expected a Wednesday's week to end the next Monday, got %s", weekEnd)
+	}
+}
+
+func TestTodoDueDates(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+
+	body := `{"title":"Dentist","dueAt":"2026-11-02T08:00:00Z","remindAt":"2026-11-01T18:00:00Z","timeZone":"Europe/Berlin"}`
+	w := send(t, testAdmin, "POST", "/api/v1/todos", body)
+	createdID(t, w)
+	todo := map[string]interface{}{}
+	json.NewDecoder(w.Body).Decode(&todo)
+	if todo["dueAt"] != "2026-11-02T09:00:00+01:00" || todo["remindAt"] != "2026-11-01T19:00:00+01:00" {
+		t.Errorf("Expected due dates in the todo's time zone, got %v and %v", todo["dueAt"], todo["remindAt"])
+	}
+
+	for _, body := range []string{
+		`{"title":"Dentist","dueAt":"2026-11-02T08:00:00Z","remindAt":"2026-11-03T08:00:00Z"}`,
+		`{"title":"Dentist","timeZone":"Mars/Olympus_Mons"}`,
+	} {
+		w = send(t, testAdmin, "POST", "/api/v1/todos", body)
+		if w.Code != 422 {
+			t.Errorf("%s: expected status code 422, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestOverdueTodos(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	for _, todo := range []*Todo{
+		{ID: "late", Title: "Late", DueAt: &past},
+		{ID: "done", Title: "Done", DueAt: &past, CompletedAt: &past},
+		{ID: "later", Title: "Later", DueAt: &future},
+		{ID: "whenever", Title: "Whenever"},
+	} {
+		todo.OwnerID = testAdmin.ID
+		todoStore.CreateTodo(ctx, todo)
+	}
+
+	todos, _ := listTodos(t, testAdmin, "/api/v1/todos?overdue=true")
+	if got := todoIDs(todos); got != "late" {
+		t.Errorf("Expected only the late todo to be overdue, got %s", got)
+	}
+	todos, _ = listTodos(t, testAdmin, "/api/v1/todos?dueAfter="+time.Now().UTC().Format(time.RFC3339))
+	if got := todoIDs(todos); got != "later" {
+		t.Errorf("Expected only the later todo, got %s", got)
+	}
+
+	w := send(t, testAdmin, "GET", "/api/v1/todos?overdue=yes", "")
+	if w.Code != 400 {
+		t.Errorf("Expected status code 400, got %d", w.Code)
+	}
+}
+
+func TestUpcomingTodos(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	loc, _ := loadLocation("America/New_York")
+	today, tomorrow, dayAfter, weekEnd := upcomingBounds(time.Now().In(loc))
+
+	due := map[string]time.Time{
+		"today":     today,
+		"tomorrow":  tomorrow.Add(9 * time.Hour),
+		"yesterday": today.Add(-time.Minute),
+		"nextweek":  weekEnd.AddDate(0, 0, 1).Add(time.Hour),
+	}
+	if dayAfter.Before(weekEnd) {
+		due["thisweek"] = dayAfter
+	}
+	for id, at := range due {
+		at := at
+		todoStore.CreateTodo(ctx, &Todo{ID: id, Title: id, OwnerID: testAdmin.ID, DueAt: &at})
+	}
+	todoStore.CreateTodo(ctx, &Todo{ID: "others", Title: "others", OwnerID: "bob", DueAt: &today})
+
+	w := send(t, testAdmin, "GET", "/api/v1/todos/upcoming?tz=America/New_York", "")
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	upcoming := &Upcoming{}
+	json.NewDecoder(w.Body).Decode(upcoming)
+	if upcoming.TimeZone != "America/New_York" {
+		t.Errorf("Expected the time zone to be echoed, got %q", upcoming.TimeZone)
+	}
+	if todoIDs(upcoming.Today) != "today" || todoIDs(upcoming.Tomorrow) != "tomorrow" {
+		t.Errorf("Expected today and tomorrow groups, got %+v", upcoming)
+	}
+	want := ""
+	if _, ok := due["thisweek"]; ok {
+		want = "thisweek"
+	}
+	if todoIDs(upcoming.ThisWeek) != want {
+		t.Errorf("Expected this week to hold %q, got %s", want, todoIDs(upcoming.ThisWeek))
+	}
+
+	w = send(t, testAdmin, "GET", "/api/v1/todos/upcoming?tz=Nowhere", "")
+	if w.Code != 400 {
+		t.Errorf("Expected status code 400 for an unknown zone, got %d", w.Code)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Stable error codes clients can rely on. They are sent in the code member
+// of every problem response.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeInvalidToken         = "invalid_token"
+	codeForbidden            = "forbidden"
+	codeMissingScope         = "missing_scope"
+	codeNotFound             = "not_found"
+	codeTodoNotFound         = "todo_not_found"
+	codeUserNotFound         = "user_not_found"
+	codeTagNotFound          = "tag_not_found"
+	codeCommentNotFound      = "comment_not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codePreconditionFailed   = "precondition_failed"
+	codePreconditionRequired = "precondition_required"
+	codeUserHasTodos         = "user_has_todos"
+	codeTodoHasSubtasks      = "todo_has_subtasks"
+	codeOpenSubtasks         = "open_subtasks"
+	codeBlocked              = "blocked"
+	codeUsernameTaken        = "username_taken"
+	codeTagExists            = "tag_exists"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codePatchFailed          = "patch_failed"
+	codeValidationFailed     = "validation_failed"
+	codeInternal             = "internal_error"
+)
+
+// APIError is an error a handler reports to the client. Err is the
+// underlying cause; it is logged but never sent.
+type APIError struct {
+	Status int
+	Code   string
+	Detail string
+	Fields []FieldError
+	Err    error
+}
+
+// FieldError describes one invalid field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func newError(status int, code, detail string) *APIError {
+	return &APIError{Status: status, Code: code, Detail: detail}
+}
+
+func badRequest(detail string, err error) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Detail: detail, Err: err}
+}
+
+func forbidden(detail string) *APIError {
+	return newError(http.StatusForbidden, codeForbidden, detail)
+}
+
+// validationFailed reports every invalid field at once.
+func validationFailed(fields ...FieldError) *APIError {
+	return &APIError{
+		Status: http.StatusUnprocessableEntity,
+		Code:   codeValidationFailed,
+		Detail: "the request has invalid fields",
+		Fields: fields,
+	}
+}
+
+// internalError hides err from the client; it only shows up in the log.
+func internalError(detail string, err error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: codeInternal, Detail: detail, Err: err}
+}
+
+// storeError maps the sentinel errors of the stores to their responses;
+// anything else is an internal error described by detail.
+func storeError(detail string, err error) *APIError {
+	switch {
+	case errors.Is(err, ErrTodoNotFound):
+		return &APIError{Status: http.StatusNotFound, Code: codeTodoNotFound, Detail: "todo not found"}
+	case errors.Is(err, ErrUserNotFound):
+		return &APIError{Status: http.StatusNotFound, Code: codeUserNotFound, Detail: "user not found"}
+	case errors.Is(err, ErrTagNotFound):
+		return &APIError{Status: http.StatusNotFound, Code: codeTagNotFound, Detail: "tag not found"}
+	case errors.Is(err, ErrCommentNotFound):
+		return &APIError{Status: http.StatusNotFound, Code: codeCommentNotFound, Detail: "comment not found"}
+	case errors.Is(err, ErrVersionConflict):
+		return errVersionMismatch
+	case errors.Is(err, ErrDuplicate):
+		return &APIError{Status: http.StatusConflict, Code: codeConflict, Detail: "already exists"}
+	}
+	return internalError(detail, err)
+}
+
+// Problem is an RFC 7807 problem details document.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// writeError renders err as application/problem+json. Errors that aren't an
+// *APIError, and internal errors, are logged and reported without details.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := requestIDFromContext(r.Context())
+	apiErr := &APIError{}
+	if !errors.As(err, &apiErr) {
+		apiErr = internalError("internal server error", err)
+	}
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.Printf("[%s] %s %s: %s\n", requestID, r.Method, r.URL.Path, apiErr)
+		apiErr = &APIError{Status: apiErr.Status, Code: apiErr.Code, Detail: "internal server error"}
+	} else if apiErr.Err != nil {
+		log.Printf("[%s] %s %s: %s\n", requestID, r.Method, r.URL.Path, apiErr)
+	}
+
+	problem := &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(apiErr.Status),
+		Status:    apiErr.Status,
+		Detail:    apiErr.Detail,
+		Instance:  r.URL.Path,
+		Code:      apiErr.Code,
+		RequestID: requestID,
+		Errors:    apiErr.Fields,
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Del("Link")
+	w.Header().Del("X-Next-Cursor")
+	w.WriteHeader(apiErr.Status)
+	err = json.NewEncoder(w).Encode(problem)
+	if err != nil {
+		log.Printf("[%s] could not encode problem: %s\n", requestID, err)
+	}
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("[%s] could not encode response: %s\n", requestIDFromContext(r.Context()), err)
+	}
+}
+
+const requestIDContextKey contextKey = "requestID"
+
+// withRequestID tags each request with the client's X-Request-ID, or a new
+// one, and echoes it back so problems can be matched to log lines.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			var err error
+			requestID, err = newRandomToken(12)
+			if err != nil {
+				log.Printf("could not generate request id: %s\n", err)
+			}
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
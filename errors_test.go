@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeProblem checks w is a problem response and returns it.
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) *Problem {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Expected a problem response, got %q: %s", ct, w.Body.String())
+	}
+	problem := &Problem{}
+	err := json.NewDecoder(w.Body).Decode(problem)
+	if err != nil {
+		t.Fatalf("Error decoding problem: %s\n", err)
+	}
+	return problem
+}
+
+func TestProblemResponses(t *testing.T) {
+	setupStores(t)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		user   *User
+		status int
+		code   string
+	}{
+		{"no token", "GET", "/api/v1/todos", "", nil, 401, codeUnauthorized},
+		{"missing scope", "GET", "/api/v1/users", "", &User{ID: "u1"}, 403, codeMissingScope},
+		{"bad body", "POST", "/api/v1/todos", "{", testAdmin, 400, codeInvalidRequest},
+		{"bad login", "POST", "/api/v1/login", `{"username":"nobody","password":"x"}`, nil, 401, codeInvalidCredentials},
+		{"no route", "GET", "/api/v1/nothing", "", nil, 404, codeNotFound},
+	}
+	for _, tt := range tests {
+		w := send(t, tt.user, tt.method, tt.target, tt.body, "X-Request-ID", "req-"+tt.name)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status code %d, got %d: %s", tt.name, tt.status, w.Code, w.Body.String())
+			continue
+		}
+		problem := decodeProblem(t, w)
+		if problem.Code != tt.code || problem.Status != tt.status {
+			t.Errorf("%s: expected code %s, got %+v", tt.name, tt.code, problem)
+		}
+		if problem.RequestID != "req-"+tt.name || w.Header().Get("X-Request-ID") != "req-"+tt.name {
+			t.Errorf("%s: expected the request id to be echoed, got %q", tt.name, problem.RequestID)
+		}
+	}
+}
+
+func TestProblemFieldErrors(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+
+	w := send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"x","ownerId":"ghost"}`)
+
+	if w.Code != 422 {
+		t.Fatalf("Expected status code 422, got %d: %s", w.Code, w.Body.String())
+	}
+	problem := decodeProblem(t, w)
+	if problem.Code != codeValidationFailed || len(problem.Errors) != 1 || problem.Errors[0].Field != "ownerId" {
+		t.Errorf("Expected a field error for ownerId, got %+v", problem)
+	}
+}
+
+func TestInternalErrorsAreNotEchoed(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v1/todos", nil)
+	writeError(w, r, internalError("could not find todos", errors.New("connection refused by mongo")))
+
+	if w.Code != 500 {
+		t.Fatalf("Expected status code 500, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "mongo") || strings.Contains(body, "could not find todos") {
+		t.Errorf("Expected internal details to stay out of the response, got %s", body)
+	}
+	problem := decodeProblem(t, w)
+	if problem.Code != codeInternal {
+		t.Errorf("Expected code %s, got %s", codeInternal, problem.Code)
+	}
+
+	w = httptest.NewRecorder()
+	writeError(w, r, errors.New("plain error"))
+	if w.Code != 500 || strings.Contains(w.Body.String(), "plain error") {
+		t.Errorf("Expected plain errors to be reported as internal, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMissingResourcesAreNotFound(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		code   string
+	}{
+		{"GET", "/api/v1/todos/nope", "", codeTodoNotFound},
+		{"PUT", "/api/v1/todos/nope", `{"title":"x"}`, codeTodoNotFound},
+		{"DELETE", "/api/v1/todos/nope", "", codeTodoNotFound},
+		{"POST", "/api/v1/todos/nope/transitions", `{"to":"started"}`, codeTodoNotFound},
+		{"GET", "/api/v1/users/nope", "", codeUserNotFound},
+		{"PUT", "/api/v1/users/nope", `{"name":"x"}`, codeUserNotFound},
+		{"DELETE", "/api/v1/users/nope", "", codeUserNotFound},
+		{"POST", "/api/v1/users/nope/logout", "", codeUserNotFound},
+	}
+	for _, tt := range tests {
+		w := send(t, testAdmin, tt.method, tt.target, tt.body)
+
+		if w.Code != 404 {
+			t.Errorf("%s %s: expected status code 404, got %d: %s", tt.method, tt.target, w.Code, w.Body.String())
+			continue
+		}
+		if problem := decodeProblem(t, w); problem.Code != tt.code {
+			t.Errorf("%s %s: expected code %s, got %s", tt.method, tt.target, tt.code, problem.Code)
+		}
+	}
+}
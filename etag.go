@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// etag is the entity tag of a todo or user at version. Every write bumps the
+// version, so the tag changes whenever the stored record does.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// matchETag reports whether an If-Match or If-None-Match header lists tag.
+// With weak comparison, which only If-None-Match may use, weak validators
+// are compared by their opaque part; otherwise they never match.
+func matchETag(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch compares the If-Match header with version before a write. It
+// writes a 412 response and returns false if the client's copy is stale. A
+// missing header is allowed unless concurrency.require_if_match is set, in
+// which case it gets 428.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int64) bool {
+	return checkIfMatchETag(w, r, etag(version))
+}
+
+// checkIfMatchETag is checkIfMatch for resources whose entity tag isn't just
+// their version.
+func checkIfMatchETag(w http.ResponseWriter, r *http.Request, tag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if viper.GetBool("concurrency.require_if_match") {
+			writeError(w, r, newError(http.StatusPreconditionRequired, codePreconditionRequired, "If-Match is required"))
+			return false
+		}
+		return true
+	}
+	if !matchETag(header, tag, false) {
+		writeError(w, r, errVersionMismatch)
+		return false
+	}
+	return true
+}
+
+var errVersionMismatch = newError(http.StatusPreconditionFailed, codePreconditionFailed, "the resource has been modified")
+
+// notModified sets the ETag of a read and, if it matches If-None-Match,
+// writes a 304 response and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, version int64) bool {
+	return notModifiedETag(w, r, etag(version))
+}
+
+// notModifiedETag is notModified for resources whose entity tag isn't just
+// their version.
+func notModifiedETag(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	header := r.Header.Get("If-None-Match")
+	if header != "" && matchETag(header, tag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestTodoETags(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+
+	w := send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Write tests"}`)
+	id := createdID(t, w)
+	if w.Header().Get("ETag") != `"1"` {
+		t.Fatalf(`Expected ETag "1" on create, got %q`, w.Header().Get("ETag"))
+	}
+	target := "/api/v1/todos/" + id
+
+	w = send(t, testAdmin, "GET", target, "", "If-None-Match", `"1"`)
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 without a body, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send(t, testAdmin, "GET", target, "", "If-None-Match", `W/"1"`)
+	if w.Code != 304 {
+		t.Errorf("Expected a weak If-None-Match to get 304, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "GET", target, "", "If-None-Match", `"0"`)
+	if w.Code != 200 || w.Header().Get("ETag") != `"1"` {
+		t.Errorf(`Expected 200 with ETag "1", got %d %q`, w.Code, w.Header().Get("ETag"))
+	}
+
+	w = send(t, testAdmin, "PUT", target, `{"title":"Write more tests"}`, "If-Match", `"1"`)
+	if w.Code != 200 || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf(`Expected 200 with ETag "2", got %d %q: %s`, w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+
+	// The other tab still holds version 1.
+	w = send(t, testAdmin, "POST", target+"/transitions", `{"to":"done"}`, "If-Match", `"1"`)
+	if w.Code != 412 {
+		t.Errorf("Expected stale transition to get 412, got %d: %s", w.Code, w.Body.String())
+	} else if problem := decodeProblem(t, w); problem.Code != codePreconditionFailed {
+		t.Errorf("Expected code %s, got %s", codePreconditionFailed, problem.Code)
+	}
+	w = send(t, testAdmin, "DELETE", target, "", "If-Match", `"1"`)
+	if w.Code != 412 {
+		t.Errorf("Expected stale delete to get 412, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "DELETE", target, "", "If-Match", `W/"2"`)
+	if w.Code != 412 {
+		t.Errorf("Expected a weak If-Match to get 412, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "DELETE", target, "", "If-Match", `"2"`)
+	if w.Code != 204 {
+		t.Errorf("Expected delete of the current version to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUserETags(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+	createTestUser(t, &User{ID: "bob", Username: "bob", Version: 3})
+
+	w := send(t, testAdmin, "GET", "/api/v1/users/bob", "", "If-None-Match", `"3"`)
+	if w.Code != 304 {
+		t.Errorf("Expected 304, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "PUT", "/api/v1/users/bob", `{"name":"Bob","username":"bob"}`, "If-Match", `"2"`)
+	if w.Code != 412 {
+		t.Errorf("Expected stale update to get 412, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send(t, testAdmin, "PUT", "/api/v1/users/bob", `{"name":"Bob","username":"bob"}`, "If-Match", `"3", "4"`)
+	if w.Code != 200 || w.Header().Get("ETag") != `"4"` {
+		t.Errorf(`Expected 200 with ETag "4", got %d %q: %s`, w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+	viper.Set("concurrency.require_if_match", true)
+	t.Cleanup(func() { viper.Set("concurrency.require_if_match", false) })
+
+	w := send(t, testAdmin, "DELETE", "/api/v1/users/"+testAdmin.ID, "")
+	if w.Code != 428 {
+		t.Errorf("Expected 428 without If-Match, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "PUT", "/api/v1/users/"+testAdmin.ID, `{"name":"Admin","username":"admin"}`, "If-Match", "*")
+	if w.Code != 200 {
+		t.Errorf("Expected If-Match: * to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMemoryStoreVersionConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryTodoStore()
+	err := store.CreateTodo(ctx, &Todo{ID: "t1", Version: 1})
+	if err != nil {
+		t.Fatalf("Error creating todo: %s\n", err)
+	}
+
+	first := &Todo{ID: "t1", Title: "first", Version: 1}
+	err = store.UpdateTodo(ctx, "t1", first)
+	if err != nil || first.Version != 2 {
+		t.Fatalf("Expected update to bump the version to 2, got %d, %v", first.Version, err)
+	}
+	second := &Todo{ID: "t1", Title: "second", Version: 1}
+	err = store.UpdateTodo(ctx, "t1", second)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict, got %v", err)
+	}
+	err = store.DeleteTodo(ctx, "t1", 1)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict, got %v", err)
+	}
+	stored, _ := store.GetTodo(ctx, "t1")
+	if stored.Title != "first" {
+		t.Errorf("Expected the first update to win, got %q", stored.Title)
+	}
+}
@@ -3,6 +3,12 @@ package main
 import "net/http"
 
 func getHealthz(w http.ResponseWriter, r *http.Request) {
+	// The memory driver has no connection to check.
+	if client == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
 	err := client.Ping(r.Context(), nil)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
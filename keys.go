@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+)
+
+// SigningKey is an RSA key pair in the key ring. Verify-only keys have no
+// private half. Retired keys are kept in the configuration for reference but
+// no longer accepted.
+type SigningKey struct {
+	ID      string
+	Private *rsa.PrivateKey
+	Public  *rsa.PublicKey
+	Retired bool
+}
+
+// KeyRing signs tokens with its active key and verifies them with any key
+// that isn't retired, so keys can be rotated without invalidating tokens
+// signed by the previous one. It is safe for concurrent use.
+type KeyRing struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*SigningKey
+}
+
+var keyRing *KeyRing
+
+// KeyConfig is one entry of rsa.keys in the settings file.
+type KeyConfig struct {
+	ID      string `mapstructure:"kid"`
+	Private string `mapstructure:"private"`
+	Public  string `mapstructure:"public"`
+	Retired bool   `mapstructure:"retired"`
+}
+
+// newKeyRing builds a key ring from keys, signing with the key whose ID is
+// active.
+func newKeyRing(active string, keys ...*SigningKey) (*KeyRing, error) {
+	kr := &KeyRing{active: active, keys: map[string]*SigningKey{}}
+	for _, key := range keys {
+		if _, ok := kr.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id: %s", key.ID)
+		}
+		kr.keys[key.ID] = key
+	}
+	key, ok := kr.keys[active]
+	if !ok {
+		return nil, fmt.Errorf("active key %s not found", active)
+	}
+	if key.Private == nil || key.Retired {
+		return nil, fmt.Errorf("active key %s cannot sign", active)
+	}
+	return kr, nil
+}
+
+// loadKeyRing reads the key ring from rsa.keys and rsa.active. Older settings
+// with a single rsa.private/rsa.public pair are still accepted; that key gets
+// its RFC 7638 thumbprint as ID.
+func loadKeyRing() (*KeyRing, error) {
+	configs := []KeyConfig{}
+	err := viper.UnmarshalKey("rsa.keys", &configs)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		key, err := parseSigningKey(&KeyConfig{
+			Private: viper.GetString("rsa.private"),
+			Public:  viper.GetString("rsa.public"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newKeyRing(key.ID, key)
+	}
+
+	keys := []*SigningKey{}
+	for i := range configs {
+		key, err := parseSigningKey(&configs[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return newKeyRing(viper.GetString("rsa.active"), keys...)
+}
+
+func parseSigningKey(kc *KeyConfig) (*SigningKey, error) {
+	key := &SigningKey{ID: kc.ID, Retired: kc.Retired}
+	var err error
+	if kc.Private != "" {
+		key.Private, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(kc.Private))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse private key %s: %w", kc.ID, err)
+		}
+		key.Public = &key.Private.PublicKey
+	}
+	if kc.Public != "" {
+		key.Public, err = jwt.ParseRSAPublicKeyFromPEM([]byte(kc.Public))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse public key %s: %w", kc.ID, err)
+		}
+	}
+	if key.Public == nil {
+		return nil, fmt.Errorf("key %s has no public key", kc.ID)
+	}
+	if key.Private != nil && !key.Private.PublicKey.Equal(key.Public) {
+		return nil, fmt.Errorf("key %s: public key does not match private key", kc.ID)
+	}
+	if key.ID == "" {
+		key.ID = thumbprint(key.Public)
+	}
+	return key, nil
+}
+
+// watchKeyRing reloads the key ring whenever the settings file changes. A
+// configuration that fails to load is logged and the current ring is kept.
+func watchKeyRing() {
+	viper.OnConfigChange(func(_ fsnotify.Event) {
+		kr, err := loadKeyRing()
+		if err != nil {
+			log.Printf("could not reload keys, keeping current ones: %s\n", err)
+			return
+		}
+		keyRing.replace(kr)
+		log.Printf("reloaded keys, signing with %s\n", kr.active)
+	})
+	viper.WatchConfig()
+}
+
+// replace swaps in the keys of other.
+func (kr *KeyRing) replace(other *KeyRing) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.active = other.active
+	kr.keys = other.keys
+}
+
+// Sign signs token with the active key and stamps its kid header.
+func (kr *KeyRing) Sign(token *jwt.Token) (string, error) {
+	kr.mu.RLock()
+	key := kr.keys[kr.active]
+	kr.mu.RUnlock()
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc picks the key to verify token with: the key named by its kid
+// header, or for tokens issued before kid headers, any key that isn't
+// retired.
+func (kr *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	_, ok := token.Method.(*jwt.SigningMethodRSA)
+	if !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		keys := jwt.VerificationKeySet{}
+		for _, key := range kr.keys {
+			if !key.Retired {
+				keys.Keys = append(keys.Keys, key.Public)
+			}
+		}
+		return keys, nil
+	}
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+	if key.Retired {
+		return nil, fmt.Errorf("key %s is retired", kid)
+	}
+	return key.Public, nil
+}
+
+// JWK is the JSON Web Key (RFC 7517) form of an RSA public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+func newJWK(kid string, pub *rsa.PublicKey) *JWK {
+	return &JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: jwt.SigningMethodRS256.Alg(),
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// thumbprint returns the RFC 7638 SHA-256 thumbprint of pub.
+func thumbprint(pub *rsa.PublicKey) string {
+	jwk := newJWK("", pub)
+	// Members in lexicographic order, no whitespace.
+	canonical := `{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKS returns the public keys that tokens may be verified with.
+func (kr *KeyRing) JWKS() *JWKS {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	jwks := &JWKS{Keys: []*JWK{}}
+	for _, key := range kr.keys {
+		if !key.Retired {
+			jwks.Keys = append(jwks.Keys, newJWK(key.ID, key.Public))
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
+
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, r, http.StatusOK, keyRing.JWKS())
+}
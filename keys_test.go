@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func generateSigningKey(t *testing.T, id string) *SigningKey {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %s\n", err)
+	}
+	return &SigningKey{ID: id, Private: priv, Public: &priv.PublicKey}
+}
+
+func TestKeyRotation(t *testing.T) {
+	setupStores(t)
+	saved := keyRing
+	t.Cleanup(func() { keyRing = saved })
+
+	oldKey := generateSigningKey(t, "old")
+	newKey := generateSigningKey(t, "new")
+	user := &User{ID: "alice", Scope: []string{scopeTodosRead}}
+
+	var err error
+	keyRing, err = newKeyRing("old", oldKey)
+	if err != nil {
+		t.Fatalf("Error creating key ring: %s\n", err)
+	}
+	oldToken, _ := createToken(user)
+
+	// Rotate: sign with the new key, keep verifying with the old one
+	keyRing.replace(&KeyRing{active: "new", keys: map[string]*SigningKey{
+		"old": {ID: "old", Public: oldKey.Public},
+		"new": newKey,
+	}})
+	newToken, _ := createToken(user)
+	parsed, _, _ := jwt.NewParser().ParseUnverified(newToken, &TodoClaims{})
+	if parsed.Header["kid"] != "new" {
+		t.Errorf("Expected kid new, got %v", parsed.Header["kid"])
+	}
+	for _, token := range []string{oldToken, newToken} {
+		w := send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+token)
+		if w.Code != 200 {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+	}
+
+	// JWKS publishes both keys
+	w := send(t, nil, "GET", "/.well-known/jwks.json", "")
+	jwks := &JWKS{}
+	json.NewDecoder(w.Body).Decode(jwks)
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "new" || jwks.Keys[1].Kid != "old" {
+		t.Errorf("Expected keys new and old, got %+v", jwks.Keys)
+	}
+
+	// Retiring the old key rejects its tokens and unpublishes it
+	keyRing.replace(&KeyRing{active: "new", keys: map[string]*SigningKey{
+		"old": {ID: "old", Public: oldKey.Public, Retired: true},
+		"new": newKey,
+	}})
+	w = send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+oldToken)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 for retired key, got %d", w.Code)
+	}
+	if len(keyRing.JWKS().Keys) != 1 {
+		t.Errorf("Expected one published key, got %d", len(keyRing.JWKS().Keys))
+	}
+}
+
+func TestNewKeyRingRequiresSigningKey(t *testing.T) {
+	key := generateSigningKey(t, "k1")
+	_, err := newKeyRing("k1", &SigningKey{ID: "k1", Public: key.Public})
+	if err == nil {
+		t.Errorf("Expected verify-only active key to be rejected")
+	}
+	_, err = newKeyRing("missing", key)
+	if err == nil {
+		t.Errorf("Expected missing active key to be rejected")
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/rsa"
 	"log"
 	"net/http"
 	"os"
@@ -10,18 +9,16 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var client *mongo.Client
-var privKey *rsa.PrivateKey
-var pubKey *rsa.PublicKey
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	setDefaults()
 	viper.SetConfigName("settings")
 	viper.AddConfigPath(".")
 	err := viper.ReadInConfig()
@@ -29,43 +26,25 @@ func main() {
 		log.Fatalf("Error reading config file: %s\n", err)
 	}
 	ctx := context.Background()
-	client, err = getMongoClient(ctx)
+	closeStores, err := openStores(ctx)
 	if err != nil {
-		log.Fatalf("Error connecting to MongoDB: %s\n", err)
+		log.Fatalf("Error opening %s storage: %s\n", viper.GetString("storage.driver"), err)
 	}
 
-	pem := viper.GetString("rsa.private")
-	privKey, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(pem))
+	keyRing, err = loadKeyRing()
 	if err != nil {
-		log.Fatalf("Error parsing private key: %s\n", err)
+		log.Fatalf("Error loading keys: %s\n", err)
 	}
+	watchKeyRing()
 
-	pem = viper.GetString("rsa.public")
-	pubKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(pem))
+	workflow, err = loadWorkflow()
 	if err != nil {
-		log.Fatalf("Error parsing public key: %s\n", err)
+		log.Fatalf("Error loading todo workflow: %s\n", err)
 	}
 
-	router := mux.NewRouter()
-	router.HandleFunc("/api/v1/healthz", getHealthz).Methods(http.MethodGet)
-
-	router.HandleFunc("/api/v1/users", getUsers).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/users", createUser).Methods(http.MethodPost)
-	router.HandleFunc("/api/v1/users/{userID}", getUser).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/users/{userID}", updateUser).Methods(http.MethodPut)
-	router.HandleFunc("/api/v1/users/{userID}", deleteUser).Methods(http.MethodDelete)
-
-	router.HandleFunc("/api/v1/todos", getTodos).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/todos", createTodo).Methods(http.MethodPost)
-	router.HandleFunc("/api/v1/todos/{todoID}", getTodo).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/todos/{todoID}", updateTodo).Methods(http.MethodPut)
-	router.HandleFunc("/api/v1/todos/{todoID}", deleteTodo).Methods(http.MethodDelete)
-
-	router.HandleFunc("/api/v1/login", getLogin).Methods(http.MethodPost)
-
 	srv := &http.Server{
 		Addr:    ":8080",
-		Handler: router,
+		Handler: newRouter(),
 	}
 	go func() {
 		log.Println("Starting server on :8080")
@@ -77,11 +56,11 @@ func main() {
 
 	<-done
 	stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Disconnect(stopCtx)
+	err = closeStores(stopCtx)
 	if err != nil {
-		log.Fatalf("Error disconnecting from MongoDB: %s\n", err)
+		log.Fatalf("Error closing storage: %s\n", err)
 	}
-	log.Println("Disconnected from MongoDB!")
+	log.Println("Storage closed!")
 
 	err = srv.Shutdown(stopCtx)
 	if err != nil {
@@ -91,3 +70,71 @@ func main() {
 
 	cancel()
 }
+
+// setDefaults registers the default for every optional setting.
+func setDefaults() {
+	viper.SetDefault("storage.driver", "mongo")
+	viper.SetDefault("token.access_ttl", "15m")
+	viper.SetDefault("token.refresh_ttl", "720h")
+	viper.SetDefault("concurrency.require_if_match", false)
+	viper.SetDefault("todos.initial_status", "new")
+	viper.SetDefault("todos.transitions", map[string][]string{
+		"new":     {"started", "done"},
+		"started": {"new", "done"},
+		"done":    {"new"},
+	})
+}
+
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(withRequestID)
+	// Middleware doesn't run for unmatched routes, so these wrap themselves.
+	router.NotFoundHandler = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, newError(http.StatusNotFound, codeNotFound, "no such resource"))
+	}))
+	router.MethodNotAllowedHandler = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, newError(http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not allowed here"))
+	}))
+	router.HandleFunc("/api/v1/healthz", getHealthz).Methods(http.MethodGet)
+	router.HandleFunc("/.well-known/jwks.json", getJWKS).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/users", requireScope(getUsers, scopeUsersRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/users", requireScope(createUser, scopeUsersWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/users/{userID}", requireScope(getUser, scopeUsersRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/users/{userID}", requireScope(updateUser, scopeUsersWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/api/v1/users/{userID}", requireScope(patchUser, scopeUsersWrite)).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v1/users/{userID}", requireScope(deleteUser, scopeUsersWrite)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v1/users/{userID}/password", requireScope(changePassword)).Methods(http.MethodPut)
+	router.HandleFunc("/api/v1/users/{userID}/logout", requireScope(logoutUser, scopeUsersWrite)).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/todos", requireScope(getTodos, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos", requireScope(createTodo, scopeTodosWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/todos/upcoming", requireScope(getUpcomingTodos, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos/{todoID}", requireScope(getTodo, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos/{todoID}", requireScope(updateTodo, scopeTodosWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/api/v1/todos/{todoID}", requireScope(patchTodo, scopeTodosWrite)).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v1/todos/{todoID}", requireScope(deleteTodo, scopeTodosWrite)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v1/todos/{todoID}/transitions", requireScope(transitionTodo, scopeTodosWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/todos/{todoID}/subtasks", requireScope(getSubtasks, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos/{todoID}/graph", requireScope(getTodoGraph, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos/{todoID}/move", requireScope(moveTodo, scopeTodosWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/todos/{todoID}/skip", requireScope(skipTodo, scopeTodosWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/todos/{todoID}/comments", requireScope(getComments, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos/{todoID}/comments", requireScope(createComment, scopeTodosWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/todos/{todoID}/comments/{commentID}", requireScope(getComment, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/todos/{todoID}/comments/{commentID}", requireScope(updateComment, scopeTodosWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/api/v1/todos/{todoID}/comments/{commentID}", requireScope(deleteComment, scopeTodosWrite)).Methods(http.MethodDelete)
+
+	router.HandleFunc("/api/v1/tags", requireScope(getTags, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/tags", requireScope(createTag, scopeTodosWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/tags/{tagID}", requireScope(getTag, scopeTodosRead)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/tags/{tagID}", requireScope(updateTag, scopeTodosWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/api/v1/tags/{tagID}", requireScope(deleteTag, scopeTodosWrite)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v1/tags/{tagID}/merge", requireScope(mergeTag, scopeTodosWrite)).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/login", getLogin).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/token/refresh", refreshToken).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/logout", requireScope(logout)).Methods(http.MethodPost)
+
+	return router
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	setDefaults()
+	viper.SetConfigName("settings")
+	viper.AddConfigPath(".")
+	err := viper.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); err != nil && !ok {
+		log.Fatalf("Error reading config file: %s\n", err)
+	}
+
+	workflow, err = loadWorkflow()
+	if err != nil {
+		log.Fatalf("Error loading todo workflow: %s\n", err)
+	}
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Error generating key: %s\n", err)
+	}
+	keyRing, err = newKeyRing("test", &SigningKey{ID: "test", Private: privKey, Public: &privKey.PublicKey})
+	if err != nil {
+		log.Fatalf("Error creating key ring: %s\n", err)
+	}
+}
+
+// setupStores opens fresh stores for a test. The in-memory driver is used
+// unless TODOSE_TEST_STORAGE names another one (e.g. "mongo").
+func setupStores(t *testing.T) {
+	t.Helper()
+	driver := os.Getenv("TODOSE_TEST_STORAGE")
+	if driver == "" {
+		driver = "memory"
+	}
+	viper.Set("storage.driver", driver)
+	ctx := context.Background()
+	closeStores, err := openStores(ctx)
+	if err != nil {
+		t.Fatalf("Error opening %s storage: %s\n", driver, err)
+	}
+	t.Cleanup(func() {
+		closeStores(ctx)
+		client = nil
+	})
+}
+
+// testAdmin holds every scope.
+var testAdmin = &User{
+	ID:       "testadmin",
+	Name:     "Admin",
+	Username: "admin",
+	Scope:    []string{scopeUsersRead, scopeUsersWrite, scopeUsersAdmin, scopeTodosRead, scopeTodosWrite, scopeTodosAdmin},
+}
+
+// authorize adds a bearer token for user to r.
+func authorize(t *testing.T, r *http.Request, user *User) *http.Request {
+	t.Helper()
+	token, err := createToken(user)
+	if err != nil {
+		t.Fatalf("Error creating token: %s\n", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// send serves a request for target as user, or without a token if user is
+// nil. headers are name, value pairs; empty values are left out. PATCH
+// bodies are sent as merge patches.
+func send(t *testing.T, user *User, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if method == "PATCH" {
+		r.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i+1] != "" {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	if user != nil {
+		r = authorize(t, r, user)
+	}
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// createdID returns the ID from the Location header of a 201 response.
+func createdID(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != 201 {
+		t.Fatalf("Expected status code 201, got %d: %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	return location[strings.LastIndex(location, "/")+1:]
+}
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryTodoStore keeps todos in a map. It is safe for concurrent use and
+// hands out copies so callers can't mutate stored values.
+type memoryTodoStore struct {
+	mu    sync.RWMutex
+	todos map[string]*Todo
+}
+
+func newMemoryTodoStore() *memoryTodoStore {
+	return &memoryTodoStore{todos: map[string]*Todo{}}
+}
+
+// copyTodo copies todo as it would be stored, without the expanded owner.
+func copyTodo(todo *Todo) *Todo {
+	c := *todo
+	c.Owner = nil
+	c.Progress = nil
+	if todo.Tags != nil {
+		c.Tags = append([]string{}, todo.Tags...)
+	}
+	if todo.BlockedBy != nil {
+		c.BlockedBy = append([]string{}, todo.BlockedBy...)
+	}
+	if todo.Recurrence != nil {
+		rec := *todo.Recurrence
+		c.Recurrence = &rec
+	}
+	return &c
+}
+
+func (s *memoryTodoStore) ListTodos(ctx context.Context, filter TodoFilter) ([]*Todo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	todos := []*Todo{}
+	for _, todo := range s.todos {
+		if !matchTodo(todo, &filter) {
+			continue
+		}
+		todos = append(todos, copyTodo(todo))
+	}
+	sort.Slice(todos, func(i, j int) bool {
+		return compareTodos(todos[i], newTodoCursor(todos[j], filter.Sort), filter.Sort) < 0
+	})
+	if filter.Limit > 0 && len(todos) > filter.Limit {
+		todos = todos[:filter.Limit]
+	}
+	return todos, nil
+}
+
+func matchTodo(todo *Todo, filter *TodoFilter) bool {
+	if filter.OwnerID != "" && todo.OwnerID != filter.OwnerID {
+		return false
+	}
+	if filter.ParentID != "" && todo.ParentID != filter.ParentID {
+		return false
+	}
+	if filter.BlockedBy != "" && !containsString(todo.BlockedBy, filter.BlockedBy) {
+		return false
+	}
+	if len(filter.Statuses) > 0 && !containsStatus(filter.Statuses, todo.Status) {
+		return false
+	}
+	if filter.Text != "" && !strings.Contains(strings.ToLower(todo.Title), strings.ToLower(filter.Text)) {
+		return false
+	}
+	if !inRange(todo.CreatedAt, filter.CreatedAfter, filter.CreatedBefore) {
+		return false
+	}
+	if !inRange(todo.UpdatedAt, filter.UpdatedAfter, filter.UpdatedBefore) {
+		return false
+	}
+	if !filter.DueAfter.IsZero() || !filter.DueBefore.IsZero() {
+		if todo.DueAt == nil || !inRange(*todo.DueAt, filter.DueAfter, filter.DueBefore) {
+			return false
+		}
+	}
+	if filter.Incomplete && todo.CompletedAt != nil {
+		return false
+	}
+	if !matchTags(todo.Tags, filter) {
+		return false
+	}
+	if filter.After != nil && compareTodos(todo, filter.After, filter.Sort) <= 0 {
+		return false
+	}
+	return true
+}
+
+func matchTags(tags []string, filter *TodoFilter) bool {
+	if len(filter.TagsAny) > 0 {
+		found := false
+		for _, tag := range filter.TagsAny {
+			found = found || containsString(tags, tag)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, tag := range filter.TagsAll {
+		if !containsString(tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range filter.TagsNone {
+		if containsString(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsStatus(statuses []TodoStatus, status TodoStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange reports whether t lies within [after, before), treating zero
+// bounds as open.
+func inRange(t, after, before time.Time) bool {
+	if !after.IsZero() && t.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// compareTodos orders todo relative to the position of cursor in sort order,
+// returning a negative number if todo comes first.
+func compareTodos(todo *Todo, cursor *TodoCursor, sort TodoSort) int {
+	c := 0
+	switch sort.Field {
+	case sortCreatedAt:
+		c = todo.CreatedAt.Compare(cursor.Time)
+	case sortUpdatedAt:
+		c = todo.UpdatedAt.Compare(cursor.Time)
+	case sortTitle:
+		c = strings.Compare(todo.Title, cursor.Title)
+	case sortPriority:
+		c = todo.Priority - cursor.Priority
+	case sortPosition:
+		c = strings.Compare(todo.Position, cursor.Position)
+	}
+	if c == 0 {
+		c = strings.Compare(todo.ID, cursor.ID)
+	}
+	if sort.Desc {
+		c = -c
+	}
+	return c
+}
+
+func (s *memoryTodoStore) GetTodo(ctx context.Context, id string) (*Todo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	todo, ok := s.todos[id]
+	if !ok {
+		return nil, fmt.Errorf("todo %s: %w", id, ErrTodoNotFound)
+	}
+	return copyTodo(todo), nil
+}
+
+func (s *memoryTodoStore) CreateTodo(ctx context.Context, todo *Todo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.todos[todo.ID]; ok {
+		return fmt.Errorf("todo %s: %w", todo.ID, ErrDuplicate)
+	}
+	s.todos[todo.ID] = copyTodo(todo)
+	return nil
+}
+
+func (s *memoryTodoStore) UpdateTodo(ctx context.Context, id string, todo *Todo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.todos[id]
+	if !ok {
+		return fmt.Errorf("todo %s: %w", id, ErrTodoNotFound)
+	}
+	if stored.Version != todo.Version {
+		return fmt.Errorf("todo %s: %w", id, ErrVersionConflict)
+	}
+	todo.Version++
+	c := copyTodo(todo)
+	c.ID = id
+	s.todos[id] = c
+	return nil
+}
+
+func (s *memoryTodoStore) DeleteTodo(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.todos[id]
+	if !ok {
+		return fmt.Errorf("todo %s: %w", id, ErrTodoNotFound)
+	}
+	if version != 0 && stored.Version != version {
+		return fmt.Errorf("todo %s: %w", id, ErrVersionConflict)
+	}
+	delete(s.todos, id)
+	return nil
+}
+
+func (s *memoryTodoStore) DeleteTodosByOwner(ctx context.Context, ownerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, todo := range s.todos {
+		if todo.OwnerID == ownerID {
+			delete(s.todos, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryTodoStore) CountSubtasks(ctx context.Context, parentIDs []string) (map[string]*Progress, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	progress := map[string]*Progress{}
+	for _, todo := range s.todos {
+		if todo.ParentID == "" || !containsString(parentIDs, todo.ParentID) {
+			continue
+		}
+		p, ok := progress[todo.ParentID]
+		if !ok {
+			p = &Progress{}
+			progress[todo.ParentID] = p
+		}
+		p.Total++
+		if todo.CompletedAt != nil {
+			p.Done++
+		}
+	}
+	return progress, nil
+}
+
+func (s *memoryTodoStore) RemoveBlocker(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, todo := range s.todos {
+		if !containsString(todo.BlockedBy, id) {
+			continue
+		}
+		blockers := []string{}
+		for _, blocker := range todo.BlockedBy {
+			if blocker != id {
+				blockers = append(blockers, blocker)
+			}
+		}
+		todo.BlockedBy = blockers
+		todo.Version++
+	}
+	return nil
+}
+
+func (s *memoryTodoStore) SetTodoPositions(ctx context.Context, positions map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, position := range positions {
+		if todo, ok := s.todos[id]; ok {
+			todo.Position = position
+			todo.Version++
+		}
+	}
+	return nil
+}
+
+func (s *memoryTodoStore) TouchTodos(ctx context.Context, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if todo, ok := s.todos[id]; ok {
+			todo.Version++
+		}
+	}
+	return nil
+}
+
+// memoryTagStore keeps tags in a map. It shares the todos of a
+// memoryTodoStore so that renaming a tag rewrites them under both locks.
+type memoryTagStore struct {
+	mu    sync.RWMutex
+	tags  map[string]*Tag
+	todos *memoryTodoStore
+}
+
+func newMemoryTagStore(todos *memoryTodoStore) *memoryTagStore {
+	return &memoryTagStore{tags: map[string]*Tag{}, todos: todos}
+}
+
+func copyTag(tag *Tag) *Tag {
+	c := *tag
+	c.Count = 0
+	return &c
+}
+
+// findTag returns ownerID's tag named name, or nil.
+func (s *memoryTagStore) findTag(ownerID, name string) *Tag {
+	for _, tag := range s.tags {
+		if tag.OwnerID == ownerID && tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+// retag replaces the tag from with to on ownerID's todos, or takes it off if
+// to is empty. s.mu must be held.
+func (s *memoryTagStore) retag(ownerID, from, to string) {
+	s.todos.mu.Lock()
+	defer s.todos.mu.Unlock()
+	for _, todo := range s.todos.todos {
+		if todo.OwnerID != ownerID || !containsString(todo.Tags, from) {
+			continue
+		}
+		tags := []string{}
+		for _, tag := range todo.Tags {
+			switch {
+			case tag != from:
+				tags = append(tags, tag)
+			case to != "" && !containsString(todo.Tags, to):
+				tags = append(tags, to)
+			}
+		}
+		todo.Tags = tags
+		todo.Version++
+	}
+}
+
+func (s *memoryTagStore) ListTags(ctx context.Context, ownerID string) ([]*Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tags := []*Tag{}
+	for _, tag := range s.tags {
+		if tag.OwnerID == ownerID {
+			tags = append(tags, copyTag(tag))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+func (s *memoryTagStore) GetTag(ctx context.Context, id string) (*Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tag, ok := s.tags[id]
+	if !ok {
+		return nil, fmt.Errorf("tag %s: %w", id, ErrTagNotFound)
+	}
+	return copyTag(tag), nil
+}
+
+func (s *memoryTagStore) CreateTag(ctx context.Context, tag *Tag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tags[tag.ID]; ok || s.findTag(tag.OwnerID, tag.Name) != nil {
+		return fmt.Errorf("tag %s: name %s: %w", tag.ID, tag.Name, ErrDuplicate)
+	}
+	s.tags[tag.ID] = copyTag(tag)
+	return nil
+}
+
+func (s *memoryTagStore) UpdateTag(ctx context.Context, id string, tag *Tag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.tags[id]
+	if !ok {
+		return fmt.Errorf("tag %s: %w", id, ErrTagNotFound)
+	}
+	if stored.Version != tag.Version {
+		return fmt.Errorf("tag %s: %w", id, ErrVersionConflict)
+	}
+	if other := s.findTag(stored.OwnerID, tag.Name); other != nil && other.ID != id {
+		return fmt.Errorf("tag %s: name %s: %w", id, tag.Name, ErrDuplicate)
+	}
+	if tag.Name != stored.Name {
+		s.retag(stored.OwnerID, stored.Name, tag.Name)
+	}
+	tag.Version++
+	c := copyTag(tag)
+	c.ID = id
+	s.tags[id] = c
+	return nil
+}
+
+func (s *memoryTagStore) MergeTag(ctx context.Context, from, into *Tag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.tags[from.ID]
+	if !ok {
+		return fmt.Errorf("tag %s: %w", from.ID, ErrTagNotFound)
+	}
+	if stored.Version != from.Version {
+		return fmt.Errorf("tag %s: %w", from.ID, ErrVersionConflict)
+	}
+	target, ok := s.tags[into.ID]
+	if !ok {
+		return fmt.Errorf("tag %s: %w", into.ID, ErrTagNotFound)
+	}
+	s.retag(stored.OwnerID, stored.Name, target.Name)
+	delete(s.tags, from.ID)
+	return nil
+}
+
+func (s *memoryTagStore) DeleteTag(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.tags[id]
+	if !ok {
+		return fmt.Errorf("tag %s: %w", id, ErrTagNotFound)
+	}
+	if version != 0 && stored.Version != version {
+		return fmt.Errorf("tag %s: %w", id, ErrVersionConflict)
+	}
+	s.retag(stored.OwnerID, stored.Name, "")
+	delete(s.tags, id)
+	return nil
+}
+
+func (s *memoryTagStore) DeleteTagsByOwner(ctx context.Context, ownerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, tag := range s.tags {
+		if tag.OwnerID == ownerID {
+			delete(s.tags, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryTagStore) EnsureTags(ctx context.Context, ownerID string, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if s.findTag(ownerID, name) != nil {
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		s.tags[id] = &Tag{ID: id, OwnerID: ownerID, Name: name, CreatedAt: currentTime(), Version: 1}
+	}
+	return nil
+}
+
+func (s *memoryTagStore) CountTags(ctx context.Context, ownerID string) (map[string]int, error) {
+	s.todos.mu.RLock()
+	defer s.todos.mu.RUnlock()
+	counts := map[string]int{}
+	for _, todo := range s.todos.todos {
+		if todo.OwnerID != ownerID {
+			continue
+		}
+		for _, tag := range todo.Tags {
+			counts[tag]++
+		}
+	}
+	return counts, nil
+}
+
+// memoryCommentStore keeps comments in a map.
+type memoryCommentStore struct {
+	mu       sync.RWMutex
+	comments map[string]*Comment
+}
+
+func newMemoryCommentStore() *memoryCommentStore {
+	return &memoryCommentStore{comments: map[string]*Comment{}}
+}
+
+func copyComment(comment *Comment) *Comment {
+	c := *comment
+	c.Author = nil
+	if comment.Mentions != nil {
+		c.Mentions = append([]string{}, comment.Mentions...)
+	}
+	if comment.History != nil {
+		c.History = append([]CommentRevision{}, comment.History...)
+	}
+	return &c
+}
+
+func (s *memoryCommentStore) ListComments(ctx context.Context, todoID string) ([]*Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	comments := []*Comment{}
+	for _, comment := range s.comments {
+		if comment.TodoID == todoID {
+			comments = append(comments, copyComment(comment))
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		if !comments[i].CreatedAt.Equal(comments[j].CreatedAt) {
+			return comments[i].CreatedAt.Before(comments[j].CreatedAt)
+		}
+		return comments[i].ID < comments[j].ID
+	})
+	return comments, nil
+}
+
+func (s *memoryCommentStore) GetComment(ctx context.Context, id string) (*Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	comment, ok := s.comments[id]
+	if !ok {
+		return nil, fmt.Errorf("comment %s: %w", id, ErrCommentNotFound)
+	}
+	return copyComment(comment), nil
+}
+
+func (s *memoryCommentStore) CreateComment(ctx context.Context, comment *Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.comments[comment.ID]; ok {
+		return fmt.Errorf("comment %s: %w", comment.ID, ErrDuplicate)
+	}
+	s.comments[comment.ID] = copyComment(comment)
+	return nil
+}
+
+func (s *memoryCommentStore) UpdateComment(ctx context.Context, id string, comment *Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.comments[id]
+	if !ok {
+		return fmt.Errorf("comment %s: %w", id, ErrCommentNotFound)
+	}
+	if stored.Version != comment.Version {
+		return fmt.Errorf("comment %s: %w", id, ErrVersionConflict)
+	}
+	comment.Version++
+	c := copyComment(comment)
+	c.ID = id
+	s.comments[id] = c
+	return nil
+}
+
+func (s *memoryCommentStore) DeleteComment(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.comments[id]
+	if !ok {
+		return fmt.Errorf("comment %s: %w", id, ErrCommentNotFound)
+	}
+	if version != 0 && stored.Version != version {
+		return fmt.Errorf("comment %s: %w", id, ErrVersionConflict)
+	}
+	delete(s.comments, id)
+	return nil
+}
+
+func (s *memoryCommentStore) DeleteCommentsByTodos(ctx context.Context, todoIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, comment := range s.comments {
+		if containsString(todoIDs, comment.TodoID) {
+			delete(s.comments, id)
+		}
+	}
+	return nil
+}
+
+// memoryUserStore keeps users in a map. It is safe for concurrent use and
+// hands out copies so callers can't mutate stored values.
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: map[string]*User{}}
+}
+
+func copyUser(user *User) *User {
+	c := *user
+	if user.Scope != nil {
+		c.Scope = append([]string{}, user.Scope...)
+	}
+	return &c
+}
+
+func (s *memoryUserStore) ListUsers(ctx context.Context, filter UserFilter) ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []*User{}
+	for _, user := range s.users {
+		if !matchUser(user, &filter) {
+			continue
+		}
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return compareUsers(users[i], &UserCursor{Username: users[j].Username, ID: users[j].ID}) < 0
+	})
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	return users, nil
+}
+
+func matchUser(user *User, filter *UserFilter) bool {
+	if filter.Prefix != "" {
+		prefix := strings.ToLower(filter.Prefix)
+		if !strings.HasPrefix(strings.ToLower(user.Name), prefix) && !strings.HasPrefix(strings.ToLower(user.Username), prefix) {
+			return false
+		}
+	}
+	if filter.Scope != "" && !user.HasScope(filter.Scope) {
+		return false
+	}
+	if filter.After != nil && compareUsers(user, filter.After) <= 0 {
+		return false
+	}
+	return true
+}
+
+// compareUsers orders user relative to the position of cursor, returning a
+// negative number if user comes first.
+func compareUsers(user *User, cursor *UserCursor) int {
+	c := strings.Compare(user.Username, cursor.Username)
+	if c == 0 {
+		c = strings.Compare(user.ID, cursor.ID)
+	}
+	return c
+}
+
+// usernameTaken reports whether a user other than id has username. Like the
+// MongoDB index, it lets any number of users have no username. The caller
+// must hold s.mu.
+func (s *memoryUserStore) usernameTaken(username, id string) bool {
+	if username == "" {
+		return false
+	}
+	for _, user := range s.users {
+		if user.Username == username && user.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryUserStore) GetUser(ctx context.Context, id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil, fmt.Errorf("user %s: %w", id, ErrUserNotFound)
+	}
+	return copyUser(user), nil
+}
+
+func (s *memoryUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.Username == username {
+			return copyUser(user), nil
+		}
+	}
+	return nil, fmt.Errorf("user %s: %w", username, ErrUserNotFound)
+}
+
+func (s *memoryUserStore) CreateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.ID]; ok {
+		return fmt.Errorf("user %s: %w", user.ID, ErrDuplicate)
+	}
+	if s.usernameTaken(user.Username, user.ID) {
+		return fmt.Errorf("user %s: username %s: %w", user.ID, user.Username, ErrDuplicate)
+	}
+	s.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (s *memoryUserStore) UpdateUser(ctx context.Context, id string, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("user %s: %w", id, ErrUserNotFound)
+	}
+	if stored.Version != user.Version {
+		return fmt.Errorf("user %s: %w", id, ErrVersionConflict)
+	}
+	if s.usernameTaken(user.Username, id) {
+		return fmt.Errorf("user %s: username %s: %w", id, user.Username, ErrDuplicate)
+	}
+	user.Version++
+	c := copyUser(user)
+	c.ID = id
+	s.users[id] = c
+	return nil
+}
+
+func (s *memoryUserStore) DeleteUser(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("user %s: %w", id, ErrUserNotFound)
+	}
+	if version != 0 && stored.Version != version {
+		return fmt.Errorf("user %s: %w", id, ErrVersionConflict)
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// memoryTokenStore keeps refresh tokens and revocations in maps. It is safe
+// for concurrent use.
+type memoryTokenStore struct {
+	mu            sync.Mutex
+	refreshTokens map[string]*RefreshToken
+	revocations   map[string]*Revocation
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{
+		refreshTokens: map[string]*RefreshToken{},
+		revocations:   map[string]*Revocation{},
+	}
+}
+
+// prune drops expired refresh tokens and revocations. The caller must hold
+// s.mu.
+func (s *memoryTokenStore) prune(now time.Time) {
+	for id, token := range s.refreshTokens {
+		if now.After(token.ExpiresAt) {
+			delete(s.refreshTokens, id)
+		}
+	}
+	for id, rev := range s.revocations {
+		if now.After(rev.ExpiresAt) {
+			delete(s.revocations, id)
+		}
+	}
+}
+
+func (s *memoryTokenStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	if _, ok := s.refreshTokens[token.ID]; ok {
+		return fmt.Errorf("refresh token %s: %w", token.ID, ErrDuplicate)
+	}
+	c := *token
+	s.refreshTokens[token.ID] = &c
+	return nil
+}
+
+func (s *memoryTokenStore) GetRefreshToken(ctx context.Context, id string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[id]
+	if !ok {
+		return nil, fmt.Errorf("refresh token %s: %w", id, ErrRefreshTokenNotFound)
+	}
+	c := *token
+	return &c, nil
+}
+
+func (s *memoryTokenStore) UseRefreshToken(ctx context.Context, id string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[id]
+	if !ok {
+		return false, fmt.Errorf("refresh token %s: %w", id, ErrRefreshTokenNotFound)
+	}
+	if token.UsedAt != nil {
+		return false, nil
+	}
+	token.UsedAt = &at
+	return true, nil
+}
+
+func (s *memoryTokenStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.refreshTokens {
+		if token.FamilyID == familyID {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.refreshTokens {
+		if token.UserID == userID {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) Revoke(ctx context.Context, rev *Revocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	c := *rev
+	s.revocations[rev.ID] = &c
+	return nil
+}
+
+func (s *memoryTokenStore) IsRevoked(ctx context.Context, claims *TodoClaims) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range []string{tokenRevocationID(claims.RegisteredClaims.ID), userRevocationID(claims.ID)} {
+		rev, ok := s.revocations[id]
+		if ok && isRevokedBy(rev, claims) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
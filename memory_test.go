@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryTodoStoreCopies(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryTodoStore()
+
+	todo := &Todo{ID: "t1", Title: "Original", OwnerID: "u1", Owner: &UserSummary{ID: "u1", Name: "Alice"}}
+	err := store.CreateTodo(ctx, todo)
+	if err != nil {
+		t.Fatalf("Error creating todo: %s\n", err)
+	}
+	todo.Title = "Changed"
+
+	stored, err := store.GetTodo(ctx, "t1")
+	if err != nil {
+		t.Fatalf("Error getting todo: %s\n", err)
+	}
+	if stored.Title != "Original" {
+		t.Errorf("Expected stored todo to be unchanged, got %+v", stored)
+	}
+	if stored.Owner != nil {
+		t.Errorf("Expected expanded owner not to be stored, got %+v", stored.Owner)
+	}
+
+	err = store.CreateTodo(ctx, &Todo{ID: "t1"})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate, got %v", err)
+	}
+}
+
+func TestMemoryUserStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryUserStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("user%d", i)
+			store.CreateUser(ctx, &User{ID: id, Username: id})
+			store.GetUserByUsername(ctx, id)
+			store.ListUsers(ctx, UserFilter{})
+		}(i)
+	}
+	wg.Wait()
+
+	users, err := store.ListUsers(ctx, UserFilter{})
+	if err != nil {
+		t.Fatalf("Error listing users: %s\n", err)
+	}
+	if len(users) != 50 {
+		t.Errorf("Expected 50 users, got %d", len(users))
+	}
+}
+
+func TestMemoryStoresReportNotFound(t *testing.T) {
+	ctx := context.Background()
+	todos := newMemoryTodoStore()
+	users := newMemoryUserStore()
+
+	checks := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"GetTodo", func() error { _, err := todos.GetTodo(ctx, "nope"); return err }(), ErrTodoNotFound},
+		{"UpdateTodo", todos.UpdateTodo(ctx, "nope", &Todo{}), ErrTodoNotFound},
+		{"DeleteTodo", todos.DeleteTodo(ctx, "nope", 0), ErrTodoNotFound},
+		{"GetUser", func() error { _, err := users.GetUser(ctx, "nope"); return err }(), ErrUserNotFound},
+		{"GetUserByUsername", func() error { _, err := users.GetUserByUsername(ctx, "nope"); return err }(), ErrUserNotFound},
+		{"UpdateUser", users.UpdateUser(ctx, "nope", &User{}), ErrUserNotFound},
+		{"DeleteUser", users.DeleteUser(ctx, "nope", 0), ErrUserNotFound},
+	}
+	for _, c := range checks {
+		if !errors.Is(c.err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, c.err)
+		}
+	}
+	if _, err := todos.ListTodos(ctx, TodoFilter{}); err != nil {
+		t.Errorf("Expected an empty listing to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Priorities of a todo, from none to high.
+const (
+	PriorityNone = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+)
+
+// Positions are strings of rankDigits compared byte by byte, so both stores
+// sort them the same way. A todo can always be placed between two others by
+// picking a position between theirs, which only writes the moved todo.
+const rankDigits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// maxPositionLength is how long positions may grow before the owner's todos
+// are respaced.
+const maxPositionLength = 24
+
+func rankDigit(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	return strings.IndexByte(rankDigits, s[i])
+}
+
+// rankBetween returns a position that sorts after lo and before hi. An empty
+// hi means there is no upper bound. Positions never end in the lowest digit,
+// so there is always room between two different ones.
+func rankBetween(lo, hi string) string {
+	if hi != "" {
+		// Keep the prefix lo and hi share, reading lo as padded with the
+		// lowest digit.
+		n := 0
+		for n < len(hi) && rankDigit(lo, n) == rankDigit(hi, n) {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(lo) {
+				rest = lo[n:]
+			}
+			return hi[:n] + rankBetween(rest, hi[n:])
+		}
+	}
+
+	l, h := rankDigit(lo, 0), len(rankDigits)
+	if hi != "" {
+		h = rankDigit(hi, 0)
+	}
+	switch {
+	case hi == "" && lo != "" && l+1 < h:
+		// Appending steps by one digit rather than halving, so a list that
+		// grows at the end keeps short positions for longer.
+		return rankDigits[l+1 : l+2]
+	case h-l > 1:
+		return rankDigits[(l+h)/2 : (l+h)/2+1]
+	case len(hi) > 1:
+		return hi[:1]
+	}
+	rest := ""
+	if len(lo) > 1 {
+		rest = lo[1:]
+	}
+	return rankDigits[l:l+1] + rankBetween(rest, "")
+}
+
+// spacedRanks returns n positions in ascending order, spread evenly with
+// room for a few moves between each pair.
+func spacedRanks(n int) []string {
+	width, space := 1, int64(len(rankDigits))
+	for space < 4*int64(n+1) {
+		width++
+		space *= int64(len(rankDigits))
+	}
+	ranks := make([]string, n)
+	for i := range ranks {
+		rank := strconv.FormatInt(int64(i+1)*space/int64(n+1), len(rankDigits))
+		rank = strings.Repeat("0", width-len(rank)) + rank
+		ranks[i] = strings.TrimRight(rank, "0")
+	}
+	return ranks
+}
+
+// respaceTodos gives all of ownerID's todos fresh positions in their current
+// order. This happens when two todos share a position, which concurrent moves
+// into the same gap can cause, or when positions have grown too long.
+func respaceTodos(ctx context.Context, ownerID string) error {
+	todos, err := todoStore.ListTodos(ctx, TodoFilter{OwnerID: ownerID, Sort: TodoSort{Field: sortPosition}})
+	if err != nil {
+		return err
+	}
+	log.Printf("respacing %d todos of %s\n", len(todos), ownerID)
+	positions := map[string]string{}
+	for i, rank := range spacedRanks(len(todos)) {
+		positions[todos[i].ID] = rank
+	}
+	return todoStore.SetTodoPositions(ctx, positions)
+}
+
+// A gap finds the positions a todo goes between. ok is false if there is no
+// room because they are the same.
+type gap func() (lo, hi string, ok bool, err error)
+
+// placeTodo returns a position in the gap in ownerID's list, respacing the
+// list once if there is no room or the position would be too long. It
+// reports whether it respaced, which changes the version of every todo.
+func placeTodo(ctx context.Context, ownerID string, find gap) (position string, respaced bool, err error) {
+	for {
+		lo, hi, ok, err := find()
+		if err != nil {
+			return "", respaced, err
+		}
+		if ok {
+			position = rankBetween(lo, hi)
+			if len(position) <= maxPositionLength || respaced {
+				return position, respaced, nil
+			}
+		} else if respaced {
+			return "", respaced, errors.New("no room to place todo after respacing")
+		}
+		err = respaceTodos(ctx, ownerID)
+		if err != nil {
+			return "", respaced, err
+		}
+		respaced = true
+	}
+}
+
+// endPosition returns a position after all of ownerID's todos.
+func endPosition(ctx context.Context, ownerID string) (string, error) {
+	position, _, err := placeTodo(ctx, ownerID, func() (string, string, bool, error) {
+		filter := TodoFilter{OwnerID: ownerID, Sort: TodoSort{Field: sortPosition, Desc: true}, Limit: 1}
+		todos, err := todoStore.ListTodos(ctx, filter)
+		if err != nil || len(todos) == 0 {
+			return "", "", true, err
+		}
+		return todos[0].Position, "", true, nil
+	})
+	return position, err
+}
+
+// MoveRequest places a todo right before or right after another todo of the
+// same owner. Exactly one of them is set.
+type MoveRequest struct {
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// moveTodo changes where a todo sits in its owner's list. Only the moved todo
+// is written, unless the list has to be respaced, so moves of different todos
+// don't conflict; moving the same todo concurrently fails the later write
+// with 412. Moving doesn't touch updatedAt.
+func moveTodo(w http.ResponseWriter, r *http.Request) {
+	log.Println("Moving todo...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil || !checkIfMatch(w, r, todo.Version) {
+		return
+	}
+	mr := &MoveRequest{}
+	err := json.NewDecoder(r.Body).Decode(mr)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode move", err))
+		return
+	}
+	if (mr.Before == "") == (mr.After == "") {
+		writeError(w, r, validationFailed(FieldError{Field: "before", Code: "required", Message: "exactly one of before and after is required"}))
+		return
+	}
+	field, targetID := "before", mr.Before
+	if mr.After != "" {
+		field, targetID = "after", mr.After
+	}
+	if targetID == todo.ID {
+		writeError(w, r, validationFailed(FieldError{Field: field, Code: "invalid_target", Message: "cannot move a todo next to itself"}))
+		return
+	}
+
+	ctx := r.Context()
+	target, err := todoStore.GetTodo(ctx, targetID)
+	if errors.Is(err, ErrTodoNotFound) || (err == nil && target.OwnerID != todo.OwnerID) {
+		writeError(w, r, validationFailed(FieldError{Field: field, Code: "invalid_target", Message: "todo " + targetID + " is not in the same list"}))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("could not find todo "+targetID, err))
+		return
+	}
+	position, respaced, err := placeTodo(ctx, todo.OwnerID, func() (string, string, bool, error) {
+		// Respacing moves the target too, so always look at its latest
+		// position.
+		target, err := todoStore.GetTodo(ctx, targetID)
+		if err != nil {
+			return "", "", false, err
+		}
+		return gapNextTo(ctx, todo, target, field == "after")
+	})
+	if err != nil {
+		writeError(w, r, internalError("could not place todo", err))
+		return
+	}
+	if respaced {
+		version := todo.Version
+		todo, err = todoStore.GetTodo(ctx, todo.ID)
+		if err != nil {
+			writeError(w, r, storeError("could not find todo", err))
+			return
+		}
+		// Respacing bumped the version once; anything more is another
+		// write the client's If-Match didn't see.
+		if todo.Version != version+1 {
+			writeError(w, r, errVersionMismatch)
+			return
+		}
+	}
+
+	todo.Position = position
+	err = todoStore.UpdateTodo(ctx, todo.ID, todo)
+	if err != nil {
+		writeError(w, r, storeError("could not move todo", err))
+		return
+	}
+	w.Header().Set("ETag", etag(todo.Version))
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+// gapNextTo finds the positions between which todo goes to land right after
+// or right before target.
+func gapNextTo(ctx context.Context, todo, target *Todo, after bool) (lo, hi string, ok bool, err error) {
+	sort := TodoSort{Field: sortPosition, Desc: !after}
+	filter := TodoFilter{OwnerID: target.OwnerID, Sort: sort, After: newTodoCursor(target, sort), Limit: 2}
+	todos, err := todoStore.ListTodos(ctx, filter)
+	if err != nil {
+		return "", "", false, err
+	}
+	var neighbour *Todo
+	for _, t := range todos {
+		if t.ID != todo.ID {
+			neighbour = t
+			break
+		}
+	}
+	if after {
+		if neighbour == nil {
+			return target.Position, "", true, nil
+		}
+		return target.Position, neighbour.Position, target.Position < neighbour.Position, nil
+	}
+	if neighbour != nil {
+		lo = neighbour.Position
+	}
+	return lo, target.Position, lo < target.Position, nil
+}
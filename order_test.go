@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRankBetween(t *testing.T) {
+	tests := []struct{ lo, hi string }{
+		{"", ""},
+		{"", "1"},
+		{"", "01"},
+		{"i", ""},
+		{"z", ""},
+		{"i", "j"},
+		{"i5", "j"},
+		{"a", "a05"},
+		{"a", "b"},
+		{"zz", ""},
+	}
+	for _, tt := range tests {
+		got := rankBetween(tt.lo, tt.hi)
+		if got <= tt.lo || (tt.hi != "" && got >= tt.hi) || strings.HasSuffix(got, "0") {
+			t.Errorf("rankBetween(%q, %q) = %q", tt.lo, tt.hi, got)
+		}
+	}
+
+	// Inserting anywhere keeps every position distinct and in order.
+	rng := rand.New(rand.NewSource(1))
+	ranks := []string{}
+	for i := 0; i < 500; i++ {
+		at := rng.Intn(len(ranks) + 1)
+		lo, hi := "", ""
+		if at > 0 {
+			lo = ranks[at-1]
+		}
+		if at < len(ranks) {
+			hi = ranks[at]
+		}
+		rank := rankBetween(lo, hi)
+		ranks = append(ranks[:at], append([]string{rank}, ranks[at:]...)...)
+	}
+	if !sort.StringsAreSorted(ranks) {
+		t.Fatalf("Expected positions to stay sorted")
+	}
+	for i := 1; i < len(ranks); i++ {
+		if ranks[i] == ranks[i-1] {
+			t.Fatalf("Expected distinct positions, got %q twice", ranks[i])
+		}
+	}
+}
+
+func TestSpacedRanks(t *testing.T) {
+	for _, n := range []int{0, 1, 8, 9, 500} {
+		ranks := spacedRanks(n)
+		if len(ranks) != n || !sort.StringsAreSorted(ranks) {
+			t.Errorf("spacedRanks(%d) = %v", n, ranks)
+		}
+		for i, rank := range ranks {
+			if rank == "" || strings.HasSuffix(rank, "0") || (i > 0 && rank == ranks[i-1]) {
+				t.Errorf("spacedRanks(%d) has bad position %q", n, rank)
+			}
+		}
+	}
+}
+
+func TestMoveTodo(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"`+id+`"}`))
+	}
+	titles := func() string {
+		todos, _ := listTodos(t, testAdmin, "/api/v1/todos?sort=position")
+		s := ""
+		for _, todo := range todos {
+			s += todo.Title
+		}
+		return s
+	}
+	idOf := map[string]string{}
+	todos, _ := listTodos(t, testAdmin, "/api/v1/todos")
+	for _, todo := range todos {
+		idOf[todo.Title] = todo.ID
+	}
+	if got := titles(); got != "abcd" {
+		t.Fatalf("Expected new todos at the end, got %s", got)
+	}
+
+	moves := []struct {
+		todo, body, want string
+	}{
+		{"d", `{"before":"` + idOf["a"] + `"}`, "dabc"},
+		{"a", `{"after":"` + idOf["c"] + `"}`, "dbca"},
+		{"b", `{"after":"` + idOf["a"] + `"}`, "dcab"},
+		{"c", `{"before":"` + idOf["a"] + `"}`, "dcab"},
+	}
+	for _, m := range moves {
+		w := send(t, testAdmin, "POST", "/api/v1/todos/"+idOf[m.todo]+"/move", m.body)
+		if w.Code != 200 {
+			t.Fatalf("Moving %s %s: expected status code 200, got %d: %s", m.todo, m.body, w.Code, w.Body.String())
+		}
+		if got := titles(); got != m.want {
+			t.Errorf("Moving %s %s: expected %s, got %s", m.todo, m.body, m.want, got)
+		}
+	}
+
+	// Two todos moved into the same gap at once end up with the same
+	// position; the next move between them respaces the list.
+	c, _ := todoStore.GetTodo(ctx, idOf["c"])
+	todoStore.SetTodoPositions(ctx, map[string]string{idOf["a"]: c.Position})
+	order := titles()
+	w := send(t, testAdmin, "POST", "/api/v1/todos/"+idOf["d"]+"/move", `{"after":"`+idOf[string(order[1])]+`"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := titles(); got != order[1:2]+"d"+order[2:3]+"b" {
+		t.Errorf("Expected d between %s and %s, got %s", order[1:2], order[2:3], got)
+	}
+
+	// A write to the moved todo while the list is respaced fails the move
+	c, _ = todoStore.GetTodo(ctx, idOf["c"])
+	todoStore.SetTodoPositions(ctx, map[string]string{idOf["a"]: c.Position})
+	order = titles()
+	first := string(order[strings.IndexAny(order, "ac")])
+	b, _ := todoStore.GetTodo(ctx, idOf["b"])
+	todoStore = &respaceRacingTodoStore{TodoStore: todoStore, raceID: b.ID}
+	w = send(t, testAdmin, "POST", "/api/v1/todos/"+b.ID+"/move", `{"after":"`+idOf[first]+`"}`, "If-Match", etag(b.Version))
+	todoStore = todoStore.(*respaceRacingTodoStore).TodoStore
+	if w.Code != 412 {
+		t.Errorf("Expected status code 412, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, body := range []string{`{}`, `{"before":"x","after":"y"}`, `{"after":"` + idOf["d"] + `"}`, `{"after":"missing"}`} {
+		w := send(t, testAdmin, "POST", "/api/v1/todos/"+idOf["d"]+"/move", body)
+		if w.Code != 422 {
+			t.Errorf("%s: expected status code 422, got %d", body, w.Code)
+		}
+	}
+	todoStore.CreateTodo(ctx, &Todo{ID: "bobs", Title: "Bob's", OwnerID: "bob"})
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+idOf["d"]+"/move", `{"after":"bobs"}`); w.Code != 422 {
+		t.Errorf("Expected moving next to another user's todo to get 422, got %d", w.Code)
+	}
+}
+
+// respaceRacingTodoStore writes the todo raceID once more right before the
+// list is respaced, as a concurrent request would.
+type respaceRacingTodoStore struct {
+	TodoStore
+	raceID string
+}
+
+func (s *respaceRacingTodoStore) SetTodoPositions(ctx context.Context, positions map[string]string) error {
+	stored, _ := s.TodoStore.GetTodo(ctx, s.raceID)
+	s.TodoStore.UpdateTodo(ctx, s.raceID, stored)
+	return s.TodoStore.SetTodoPositions(ctx, positions)
+}
+
+func TestTodoPriority(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	for i, priority := range []int{PriorityLow, PriorityHigh, PriorityNone, PriorityMedium} {
+		todoStore.CreateTodo(ctx, &Todo{ID: fmt.Sprint(i), Title: "todo", OwnerID: testAdmin.ID, Priority: priority})
+	}
+	todos, _ := listTodos(t, testAdmin, "/api/v1/todos?sort=-priority&limit=2")
+	if got := todoIDs(todos); got != "13" {
+		t.Errorf("Expected the highest priorities first, got %s", got)
+	}
+
+	for _, body := range []string{`{"title":"todo","priority":4}`, `{"title":"todo","priority":-1}`} {
+		if w := send(t, testAdmin, "POST", "/api/v1/todos", body); w.Code != 422 {
+			t.Errorf("%s: expected status code 422, got %d", body, w.Code)
+		}
+	}
+}
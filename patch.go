@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeJSON       = "application/json"
+	contentTypeMergePatch = "application/merge-patch+json"
+)
+
+// mediaType returns the media type of the request body without parameters.
+func mediaType(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// applyMergePatch applies an RFC 7396 JSON Merge Patch to the JSON document
+// doc and returns the patched document.
+func applyMergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p interface{}
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(patch, &p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+const contentTypeJSONPatch = "application/json-patch+json"
+
+// checkPatchType writes a 415 response and returns false unless the request
+// body is a JSON Patch or a JSON Merge Patch. Plain JSON is taken as a merge
+// patch.
+func checkPatchType(w http.ResponseWriter, r *http.Request) bool {
+	switch mediaType(r) {
+	case contentTypeMergePatch, contentTypeJSON, contentTypeJSONPatch:
+		return true
+	}
+	writeError(w, r, newError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+		"use "+contentTypeMergePatch+" or "+contentTypeJSONPatch))
+	return false
+}
+
+// patchRequest applies the patch in the body of r to the JSON document doc.
+// Malformed patches are 400s; patches that don't apply to doc are 422s.
+func patchRequest(r *http.Request, doc []byte) ([]byte, error) {
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, badRequest("could not read patch", err)
+	}
+	if mediaType(r) == contentTypeJSONPatch {
+		doc, err = applyJSONPatch(doc, patch)
+	} else {
+		doc, err = applyMergePatch(doc, patch)
+	}
+	opErr := &PatchOpError{}
+	if errors.As(err, &opErr) {
+		return nil, &APIError{Status: http.StatusUnprocessableEntity, Code: codePatchFailed, Detail: opErr.Error()}
+	}
+	if err != nil {
+		return nil, badRequest("could not apply patch", err)
+	}
+	return doc, nil
+}
+
+// PatchOperation is one operation of an RFC 6902 JSON Patch.
+type PatchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// PatchOpError reports the operation of a JSON Patch that could not be
+// applied.
+type PatchOpError struct {
+	Index int
+	Op    *PatchOperation
+	Err   error
+}
+
+func (e *PatchOpError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %s", e.Index, e.Op.Op, e.Op.Path, e.Err)
+}
+
+func (e *PatchOpError) Unwrap() error {
+	return e.Err
+}
+
+// applyJSONPatch applies an RFC 6902 JSON Patch to the JSON document doc and
+// returns the patched document. The operations apply in order to a copy of
+// doc, so if any of them fails doc is left as it was.
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, err
+	}
+	ops := []*PatchOperation{}
+	err = json.Unmarshal(patch, &ops)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		target, err = applyPatchOperation(target, op)
+		if err != nil {
+			return nil, &PatchOpError{Index: i, Op: op, Err: err}
+		}
+	}
+	return json.Marshal(target)
+}
+
+func applyPatchOperation(doc interface{}, op *PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("value is required")
+		}
+		err = json.Unmarshal(*op.Value, &value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err = pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err = pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if len(from) < len(path) && isPointerPrefix(from, path) {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			doc, value, err = pointerRemove(doc, from)
+		} else {
+			value, err = pointerGet(doc, from)
+			value = deepCopyJSON(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference
+// tokens. The empty pointer refers to the whole document.
+func parsePointer(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPointerPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses token as an index into an array of length n. "-" means
+// the position after the last element, which only add may use.
+func arrayIndex(token string, n int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	max := n - 1
+	if allowEnd {
+		max = n
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			next, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+			doc = next
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("cannot index a scalar with %q", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd returns doc with value added at path. Arrays grow rather than
+// having an element replaced.
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		v[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(v), true)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, nil)
+		copy(v[i+1:], v[i:])
+		v[i] = value
+		return pointerSet(doc, path[:len(path)-1], v)
+	}
+	return nil, fmt.Errorf("cannot add to a scalar at %q", last)
+}
+
+// pointerRemove returns doc without the value at path, and that value.
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		removed, ok := v[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("no member %q", last)
+		}
+		delete(v, last)
+		return doc, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(v), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed := v[i]
+		v = append(v[:i:i], v[i+1:]...)
+		doc, err = pointerSet(doc, path[:len(path)-1], v)
+		return doc, removed, err
+	}
+	return nil, nil, fmt.Errorf("cannot remove from a scalar at %q", last)
+}
+
+// pointerSet replaces the existing value at path. Arrays that change length
+// have to be stored back into their parent this way.
+func pointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		v[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(v), false)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = value
+	}
+	return doc, nil
+}
+
+func deepCopyJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = deepCopyJSON(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = deepCopyJSON(e)
+		}
+		return c
+	}
+	return v
+}
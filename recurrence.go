@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence makes a todo one occurrence of a series that repeats by Rule,
+// an RRULE evaluated from Start in the todo's time zone. Only Rule is set by
+// clients: SeriesID is the ID of the todo the series started with, Start its
+// due time, and At the occurrence this todo stands for, which stays put if
+// the todo's due date is moved.
+type Recurrence struct {
+	Rule     string    `json:"rule" bson:"rule"`
+	SeriesID string    `json:"seriesId" bson:"seriesId"`
+	Start    time.Time `json:"start" bson:"start"`
+	At       time.Time `json:"at" bson:"at"`
+}
+
+// RRule is the part of an RFC 5545 recurrence rule todos support:
+//
+//	FREQ        DAILY, WEEKLY, MONTHLY or YEARLY
+//	INTERVAL    every how many days, weeks, months or years
+//	COUNT       how many occurrences there are, the first included
+//	UNTIL       the last possible occurrence, as 20261231T235959Z, or a
+//	            date such as 20261231
+//	BYDAY       weekdays such as MO,WE; for MONTHLY they may be numbered,
+//	            as in 1MO or -1FR for the first Monday or the last Friday
+//	BYMONTHDAY  days of the month for MONTHLY, negative ones from the end
+//	BYMONTH     months for YEARLY
+//	WKST        the day weeks start on, MO by default
+//
+// Days that don't exist, such as the 31st of a short month, are skipped.
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	UntilDate  bool
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+	WeekStart  time.Weekday
+}
+
+// WeekdayNum is a BYDAY entry: every Day, or with N the Nth one in the
+// month, counting from the end if N is negative.
+type WeekdayNum struct {
+	N   int
+	Day time.Weekday
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// maxPeriods bounds the search for occurrences, so that rules which rarely
+// or never match still end.
+const maxPeriods = 10000
+
+func parseRRule(s string) (*RRule, error) {
+	rule := &RRule{Interval: 1, WeekStart: time.Monday}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(s), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s is given twice", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rule.Freq = value
+			default:
+				err = errors.New("unsupported frequency " + value)
+			}
+		case "INTERVAL":
+			rule.Interval, err = parseRRuleInt(name, value, 1, 1000)
+		case "COUNT":
+			rule.Count, err = parseRRuleInt(name, value, 1, 10000)
+		case "UNTIL":
+			rule.Until, err = time.Parse("20060102T150405Z", value)
+			if err != nil {
+				rule.Until, err = time.Parse("20060102", value)
+				rule.UntilDate = true
+			}
+			if err != nil {
+				err = errors.New("UNTIL must look like 20261231T235959Z or 20261231")
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				wd := WeekdayNum{}
+				if len(day) > 2 {
+					wd.N, err = strconv.Atoi(day[:len(day)-2])
+					if err != nil || wd.N == 0 || wd.N < -5 || wd.N > 5 {
+						return nil, fmt.Errorf("invalid BYDAY %s", day)
+					}
+				}
+				wd.Day, ok = rruleWeekdays[day[max(len(day)-2, 0):]]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %s", day)
+				}
+				rule.ByDay = append(rule.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := parseRRuleInt(name, day, -31, 31)
+				if err != nil || n == 0 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY %s", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, month := range strings.Split(value, ",") {
+				n, err := parseRRuleInt(name, month, 1, 12)
+				if err != nil {
+					return nil, err
+				}
+				rule.ByMonth = append(rule.ByMonth, time.Month(n))
+			}
+		case "WKST":
+			rule.WeekStart, ok = rruleWeekdays[value]
+			if !ok {
+				err = errors.New("invalid WKST " + value)
+			}
+		default:
+			err = errors.New("unsupported rule part " + name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case rule.Freq == "":
+		return nil, errors.New("FREQ is required")
+	case rule.Count > 0 && !rule.Until.IsZero():
+		return nil, errors.New("COUNT and UNTIL cannot be used together")
+	case len(rule.ByMonthDay) > 0 && rule.Freq != "MONTHLY":
+		return nil, errors.New("BYMONTHDAY only works with FREQ=MONTHLY")
+	case len(rule.ByMonth) > 0 && rule.Freq != "YEARLY":
+		return nil, errors.New("BYMONTH only works with FREQ=YEARLY")
+	case len(rule.ByDay) > 0 && rule.Freq == "YEARLY":
+		return nil, errors.New("BYDAY does not work with FREQ=YEARLY")
+	case len(rule.ByDay) > 0 && len(rule.ByMonthDay) > 0:
+		return nil, errors.New("BYDAY and BYMONTHDAY cannot be used together")
+	}
+	for _, wd := range rule.ByDay {
+		if wd.N != 0 && rule.Freq != "MONTHLY" {
+			return nil, errors.New("numbered BYDAY only works with FREQ=MONTHLY")
+		}
+	}
+	return rule, nil
+}
+
+func parseRRuleInt(name, value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be a number from %d to %d", name, min, max)
+	}
+	return n, nil
+}
+
+// each calls fn with the occurrences of the rule from start in order, until
+// fn returns false or the rule ends. start is always the first occurrence.
+// Occurrences are in start's location at start's wall clock time, so a
+// todo due at 9:00 stays at 9:00 across daylight saving changes; a time
+// that is skipped when clocks go forward is moved forward by the gap.
+func (rule *RRule) each(start time.Time, fn func(time.Time) bool) {
+	count := 0
+	emit := func(t time.Time) bool {
+		if rule.Count > 0 && count == rule.Count {
+			return false
+		}
+		if rule.UntilDate {
+			y, m, d := t.Date()
+			if time.Date(y, m, d, 0, 0, 0, 0, time.UTC).After(rule.Until) {
+				return false
+			}
+		} else if !rule.Until.IsZero() && t.After(rule.Until) {
+			return false
+		}
+		count++
+		return fn(t)
+	}
+	if !emit(start) {
+		return
+	}
+
+	year, month, day := start.Date()
+	hour, min, sec := start.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, min, sec, 0, start.Location())
+	}
+	for k := 0; k < maxPeriods; k++ {
+		n := k * rule.Interval
+		var times []time.Time
+		switch rule.Freq {
+		case "DAILY":
+			t := at(year, month, day+n)
+			if len(rule.ByDay) == 0 || rule.onWeekday(t.Weekday()) {
+				times = append(times, t)
+			}
+		case "WEEKLY":
+			weekStart := day - int((start.Weekday()-rule.WeekStart+7)%7) + 7*n
+			days := rule.ByDay
+			if len(days) == 0 {
+				days = []WeekdayNum{{Day: start.Weekday()}}
+			}
+			for _, wd := range days {
+				times = append(times, at(year, month, weekStart+int((wd.Day-rule.WeekStart+7)%7)))
+			}
+		case "MONTHLY":
+			first := time.Date(year, month+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+			for _, d := range rule.monthDays(first.Year(), first.Month(), day) {
+				times = append(times, at(first.Year(), first.Month(), d))
+			}
+		case "YEARLY":
+			months := rule.ByMonth
+			if len(months) == 0 {
+				months = []time.Month{month}
+			}
+			for _, m := range months {
+				if day <= daysIn(year+n, m) {
+					times = append(times, at(year+n, m, day))
+				}
+			}
+		}
+
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for i, t := range times {
+			if !t.After(start) || (i > 0 && t.Equal(times[i-1])) {
+				continue
+			}
+			if !emit(t) {
+				return
+			}
+		}
+	}
+}
+
+func (rule *RRule) onWeekday(day time.Weekday) bool {
+	for _, wd := range rule.ByDay {
+		if wd.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// monthDays returns the days of a month a MONTHLY rule falls on. startDay
+// is used if the rule names no days.
+func (rule *RRule) monthDays(year int, month time.Month, startDay int) []int {
+	dim := daysIn(year, month)
+	days := []int{}
+	switch {
+	case len(rule.ByMonthDay) > 0:
+		for _, d := range rule.ByMonthDay {
+			if d < 0 {
+				d += dim + 1
+			}
+			if d >= 1 && d <= dim {
+				days = append(days, d)
+			}
+		}
+	case len(rule.ByDay) > 0:
+		firstDay := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Weekday()
+		for _, wd := range rule.ByDay {
+			all := []int{}
+			for d := 1 + int((wd.Day-firstDay+7)%7); d <= dim; d += 7 {
+				all = append(all, d)
+			}
+			switch {
+			case wd.N == 0:
+				days = append(days, all...)
+			case wd.N > 0 && wd.N <= len(all):
+				days = append(days, all[wd.N-1])
+			case wd.N < 0 && -wd.N <= len(all):
+				days = append(days, all[len(all)+wd.N])
+			}
+		}
+	case startDay <= dim:
+		days = append(days, startDay)
+	}
+	return days
+}
+
+// next returns the first occurrence after the given time, or false if the
+// rule has ended by then.
+func (rule *RRule) next(start, after time.Time) (time.Time, bool) {
+	var next time.Time
+	rule.each(start, func(t time.Time) bool {
+		if t.After(after) {
+			next = t
+			return false
+		}
+		return true
+	})
+	return next, !next.IsZero()
+}
+
+// checkRecurrence returns the violations of a todo's recurrence.
+func checkRecurrence(todo *Todo) []FieldError {
+	if todo.Recurrence == nil {
+		return nil
+	}
+	_, err := parseRRule(todo.Recurrence.Rule)
+	if err != nil {
+		return []FieldError{{Field: "recurrence", Code: "invalid_recurrence", Message: err.Error()}}
+	}
+	if todo.DueAt == nil {
+		return []FieldError{{Field: "recurrence", Code: "missing_due", Message: "needs dueAt to start from"}}
+	}
+	return nil
+}
+
+// keepSeries fills in the server-set fields of todo's recurrence, keeping
+// those of existing, which is nil for new todos, if the rule is the same.
+// A new or changed rule starts a new series at todo's due date.
+func keepSeries(existing, todo *Todo) {
+	if todo.Recurrence == nil {
+		return
+	}
+	if existing != nil && existing.Recurrence != nil && existing.Recurrence.Rule == todo.Recurrence.Rule {
+		rec := *existing.Recurrence
+		todo.Recurrence = &rec
+		return
+	}
+	todo.Recurrence.SeriesID = todo.ID
+	todo.Recurrence.Start = *todo.DueAt
+	todo.Recurrence.At = *todo.DueAt
+}
+
+// nextOccurrence returns the todo for the occurrence after todo's, or nil
+// if the series has ended. The next todo starts out fresh with the same
+// title, owner, priority, tags and time zone; its ID is derived from the
+// occurrence, so scheduling the same one twice fails with ErrDuplicate.
+func nextOccurrence(todo *Todo) (*Todo, error) {
+	rec := todo.Recurrence
+	rule, err := parseRRule(rec.Rule)
+	if err != nil {
+		return nil, err
+	}
+	loc := time.UTC
+	if todo.TimeZone != "" {
+		loc, err = loadLocation(todo.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	at, ok := rule.next(rec.Start.In(loc), rec.At)
+	if !ok {
+		return nil, nil
+	}
+
+	now := currentTime()
+	next := &Todo{
+		ID:        rec.SeriesID + "." + strconv.FormatInt(at.Unix(), 36),
+		Title:     todo.Title,
+		Status:    workflow.Initial,
+		OwnerID:   todo.OwnerID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		CreatedBy: todo.CreatedBy,
+		TimeZone:  todo.TimeZone,
+		Priority:  todo.Priority,
+		Tags:      todo.Tags,
+		Recurrence: &Recurrence{
+			Rule:     rec.Rule,
+			SeriesID: rec.SeriesID,
+			Start:    rec.Start,
+			At:       at,
+		},
+		Version: 1,
+	}
+	next.DueAt = &at
+	if todo.RemindAt != nil && todo.DueAt != nil {
+		remindAt := at.Add(todo.RemindAt.Sub(*todo.DueAt))
+		next.RemindAt = &remindAt
+	}
+	normalizeDueDates(next)
+	return next, nil
+}
+
+// scheduleNext creates the occurrence after todo if it recurs, and returns
+// it, or nil if there is none or it was already created. It writes the
+// error response and returns false if that fails.
+func scheduleNext(w http.ResponseWriter, r *http.Request, todo *Todo) (*Todo, bool) {
+	if todo.Recurrence == nil {
+		return nil, true
+	}
+	next, err := nextOccurrence(todo)
+	if err == nil && next != nil {
+		next.Position, err = endPosition(r.Context(), next.OwnerID)
+	}
+	if err == nil && next != nil {
+		err = todoStore.CreateTodo(r.Context(), next)
+		if errors.Is(err, ErrDuplicate) {
+			next, err = nil, nil
+		}
+	}
+	if err != nil {
+		writeError(w, r, internalError("could not schedule the next occurrence", err))
+		return nil, false
+	}
+	return next, true
+}
+
+// skipTodo skips an occurrence of a recurring todo: the next occurrence is
+// created and this one deleted, along with its subtasks as deleteTodo would.
+// The response is the next occurrence, or 204 if the series has ended.
+func skipTodo(w http.ResponseWriter, r *http.Request) {
+	log.Println("Skipping todo...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil || !checkIfMatch(w, r, todo.Version) {
+		return
+	}
+	if todo.Recurrence == nil {
+		writeError(w, r, validationFailed(FieldError{Field: "recurrence", Code: "not_recurring", Message: "only occurrences of recurring todos can be skipped"}))
+		return
+	}
+	if todo.CompletedAt != nil {
+		writeError(w, r, validationFailed(FieldError{Field: "status", Code: "invalid_transition", Message: "todo is already done"}))
+		return
+	}
+	next, ok := scheduleNext(w, r, todo)
+	if !ok || !removeTodo(w, r, todo) {
+		return
+	}
+	if next == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/todos/"+next.ID)
+	w.Header().Set("ETag", etag(next.Version))
+	writeJSON(w, r, http.StatusCreated, next)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRRuleOccurrences(t *testing.T) {
+	berlin, _ := loadLocation("Europe/Berlin")
+	tests := []struct {
+		rule  string
+		start time.Time
+		want  []string
+		ends  bool
+	}{
+		// Clocks go forward on 2026-03-29; the todo stays at 9:00.
+		{"FREQ=WEEKLY;BYDAY=MO,WE", time.Date(2026, 3, 23, 9, 0, 0, 0, berlin), []string{
+			"2026-03-23T09:00:00+01:00", "2026-03-25T09:00:00+01:00", "2026-03-30T09:00:00+02:00", "2026-04-01T09:00:00+02:00",
+		}, false},
+		{"FREQ=DAILY", time.Date(2026, 3, 28, 2, 30, 0, 0, berlin), []string{
+			"2026-03-28T02:30:00+01:00", "2026-03-29T03:30:00+02:00", "2026-03-30T02:30:00+02:00",
+		}, false},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH", time.Date(2026, 1, 7, 18, 0, 0, 0, time.UTC), []string{
+			"2026-01-07T18:00:00Z", "2026-01-08T18:00:00Z", "2026-01-20T18:00:00Z", "2026-01-22T18:00:00Z",
+		}, false},
+		{"FREQ=MONTHLY", time.Date(2026, 1, 31, 8, 0, 0, 0, time.UTC), []string{
+			"2026-01-31T08:00:00Z", "2026-03-31T08:00:00Z", "2026-05-31T08:00:00Z",
+		}, false},
+		{"FREQ=MONTHLY;BYDAY=-1FR", time.Date(2026, 1, 30, 8, 0, 0, 0, time.UTC), []string{
+			"2026-01-30T08:00:00Z", "2026-02-27T08:00:00Z", "2026-03-27T08:00:00Z",
+		}, false},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,-1", time.Date(2026, 2, 1, 8, 0, 0, 0, time.UTC), []string{
+			"2026-02-01T08:00:00Z", "2026-02-28T08:00:00Z", "2026-03-01T08:00:00Z",
+		}, false},
+		{"FREQ=YEARLY", time.Date(2024, 2, 29, 8, 0, 0, 0, time.UTC), []string{
+			"2024-02-29T08:00:00Z", "2028-02-29T08:00:00Z", "2032-02-29T08:00:00Z",
+		}, false},
+		{"FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=3", time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC), []string{
+			"2026-10-16T08:00:00Z", "2026-10-19T08:00:00Z", "2026-10-20T08:00:00Z",
+		}, true},
+		{"RRULE:FREQ=DAILY;INTERVAL=3;UNTIL=20261007", time.Date(2026, 10, 1, 23, 0, 0, 0, berlin), []string{
+			"2026-10-01T23:00:00+02:00", "2026-10-04T23:00:00+02:00", "2026-10-07T23:00:00+02:00",
+		}, true},
+	}
+	for _, tt := range tests {
+		rule, err := parseRRule(tt.rule)
+		if err != nil {
+			t.Errorf("%s: %v", tt.rule, err)
+			continue
+		}
+		got := []string{}
+		var last time.Time
+		rule.each(tt.start, func(at time.Time) bool {
+			got = append(got, at.Format(time.RFC3339))
+			last = at
+			return len(got) < len(tt.want)
+		})
+		if _, more := rule.next(tt.start, last); more == tt.ends {
+			t.Errorf("%s: expected the rule to end after %v: %t", tt.rule, last, tt.ends)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.rule, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: expected %v, got %v", tt.rule, tt.want, got)
+				break
+			}
+		}
+	}
+
+	invalid := []string{
+		"", "INTERVAL=2", "FREQ=HOURLY", "FREQ=DAILY;FREQ=WEEKLY", "FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231", "FREQ=WEEKLY;BYDAY=1MO", "FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=MONTHLY;BYDAY=XX", "FREQ=MONTHLY;BYMONTHDAY=32", "FREQ=DAILY;BYHOUR=9",
+	}
+	for _, s := range invalid {
+		if _, err := parseRRule(s); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+func TestRecurringTodos(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	body := `{"title":"Take out the bins","timeZone":"Europe/Berlin","dueAt":"2026-03-26T19:00:00+01:00",` +
+		`"remindAt":"2026-03-26T18:00:00+01:00","tags":["chores"],"recurrence":{"rule":"FREQ=WEEKLY;COUNT=3"}}`
+	first := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", body))
+
+	invalid := []struct{ body, code string }{
+		{`{"title":"Bins","recurrence":{"rule":"FREQ=WEEKLY"}}`, "missing_due"},
+		{`{"title":"Bins","dueAt":"2026-03-26T19:00:00Z","recurrence":{"rule":"FREQ=HOURLY"}}`, "invalid_recurrence"},
+	}
+	for _, tt := range invalid {
+		w := send(t, testAdmin, "POST", "/api/v1/todos", tt.body)
+		if w.Code != 422 || decodeProblem(t, w).Errors[0].Code != tt.code {
+			t.Errorf("%s: expected %s, got %d: %s", tt.body, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	// Completing an occurrence schedules the next one at the same local time
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+first+"/transitions", `{"to":"done"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	todos, _ := todoStore.ListTodos(ctx, TodoFilter{})
+	if len(todos) != 2 {
+		t.Fatalf("Expected the next occurrence to be created, got %d todos", len(todos))
+	}
+	next := todos[0]
+	if next.ID == first {
+		next = todos[1]
+	}
+	w := send(t, testAdmin, "GET", "/api/v1/todos/"+next.ID, "")
+	got := map[string]any{}
+	json.NewDecoder(w.Body).Decode(&got)
+	if got["dueAt"] != "2026-04-02T19:00:00+02:00" || got["remindAt"] != "2026-04-02T18:00:00+02:00" || got["status"] != "new" {
+		t.Errorf("Expected the next occurrence a week later at 19:00, got %v", got)
+	}
+	if rec := got["recurrence"].(map[string]any); rec["seriesId"] != first || rec["at"] != "2026-04-02T19:00:00+02:00" {
+		t.Errorf("Expected the occurrence to belong to the series, got %v", rec)
+	}
+
+	// A completion that loses a race schedules nothing
+	todoStore = &racingTodoStore{TodoStore: todoStore, raceID: next.ID}
+	for _, method := range []string{"PATCH", "POST"} {
+		target, body := "/api/v1/todos/"+next.ID, `{"status":"done"}`
+		if method == "POST" {
+			target, body = target+"/transitions", `{"to":"done"}`
+		}
+		if w := send(t, testAdmin, method, target, body); w.Code != 412 {
+			t.Errorf("%s %s: expected status code 412, got %d: %s", method, target, w.Code, w.Body.String())
+		}
+	}
+	todoStore = todoStore.(*racingTodoStore).TodoStore
+	if todos, _ := todoStore.ListTodos(ctx, TodoFilter{}); len(todos) != 2 {
+		t.Errorf("Expected no occurrence for the failed completions, got %d todos", len(todos))
+	}
+
+	// Completing the same occurrence again doesn't schedule it twice
+	send(t, testAdmin, "POST", "/api/v1/todos/"+first+"/transitions", `{"to":"new"}`)
+	send(t, testAdmin, "PATCH", "/api/v1/todos/"+first, `{"status":"done"}`)
+	if todos, _ := todoStore.ListTodos(ctx, TodoFilter{}); len(todos) != 2 {
+		t.Errorf("Expected 2 todos, got %d", len(todos))
+	}
+
+	// Skipping replaces an occurrence with the next; the series ends at COUNT
+	w = send(t, testAdmin, "POST", "/api/v1/todos/"+next.ID+"/skip", "")
+	last := createdID(t, w)
+	if _, err := todoStore.GetTodo(ctx, next.ID); err == nil {
+		t.Errorf("Expected the skipped occurrence to be deleted")
+	}
+	if todo, _ := todoStore.GetTodo(ctx, last); !todo.DueAt.Equal(time.Date(2026, 4, 9, 17, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the last occurrence on 2026-04-09, got %v", todo.DueAt)
+	}
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+last+"/skip", ""); w.Code != 204 {
+		t.Errorf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if todos, _ := todoStore.ListTodos(ctx, TodoFilter{}); len(todos) != 1 {
+		t.Errorf("Expected the series to end, got %d todos", len(todos))
+	}
+
+	// Only open occurrences of recurring todos can be skipped
+	plain := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Once"}`))
+	for _, id := range []string{plain, first} {
+		if w := send(t, testAdmin, "POST", "/api/v1/todos/"+id+"/skip", ""); w.Code != 422 {
+			t.Errorf("Expected status code 422, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
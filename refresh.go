@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RefreshToken is the server-side record of an issued refresh token. Only a
+// hash of the token value is stored. Tokens rotate on every use, and all
+// tokens descended from the same login share a FamilyID so that replaying an
+// already-used token can revoke the whole chain.
+type RefreshToken struct {
+	ID        string     `json:"id" bson:"_id"`
+	UserID    string     `json:"userId" bson:"userId"`
+	FamilyID  string     `json:"familyId" bson:"familyId"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt" bson:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" bson:"usedAt"`
+	Revoked   bool       `json:"revoked" bson:"revoked"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// TokenResponse is returned by login and token refresh.
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// newRandomToken returns n random bytes encoded as base64url.
+func newRandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// createRefreshToken issues a refresh token for user in familyID, starting a
+// new family if familyID is empty. It returns the token value to hand out.
+func createRefreshToken(r *http.Request, user *User, familyID string) (string, error) {
+	value, err := newRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if familyID == "" {
+		familyID, err = newRandomToken(16)
+		if err != nil {
+			return "", err
+		}
+	}
+	now := time.Now()
+	rt := &RefreshToken{
+		ID:        hashRefreshToken(value),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(viper.GetDuration("token.refresh_ttl")),
+	}
+	err = tokenStore.CreateRefreshToken(r.Context(), rt)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// writeTokens issues an access token and a refresh token for user and writes
+// them as the response.
+func writeTokens(w http.ResponseWriter, r *http.Request, user *User, familyID string) {
+	token, err := createToken(user)
+	if err != nil {
+		writeError(w, r, internalError("could not create token", err))
+		return
+	}
+	refreshToken, err := createRefreshToken(r, user, familyID)
+	if err != nil {
+		writeError(w, r, internalError("could not create refresh token", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, &TokenResponse{Token: token, RefreshToken: refreshToken})
+}
+
+var errInvalidRefreshToken = newError(http.StatusUnauthorized, codeInvalidToken, "invalid refresh token")
+
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	log.Println("Refreshing token...")
+	rr := &RefreshRequest{}
+	err := json.NewDecoder(r.Body).Decode(rr)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode refresh request", err))
+		return
+	}
+
+	rt, err := tokenStore.GetRefreshToken(r.Context(), hashRefreshToken(rr.RefreshToken))
+	if err != nil && !errors.Is(err, ErrRefreshTokenNotFound) {
+		writeError(w, r, internalError("could not find refresh token", err))
+		return
+	}
+	if err != nil {
+		log.Printf("could not find refresh token: %s\n", err)
+		writeError(w, r, errInvalidRefreshToken)
+		return
+	}
+	if rt.Revoked || time.Now().After(rt.ExpiresAt) {
+		writeError(w, r, errInvalidRefreshToken)
+		return
+	}
+
+	// Marking the token used is atomic, so of two concurrent refreshes with
+	// the same token only one wins; the other is treated as a replay.
+	fresh, err := tokenStore.UseRefreshToken(r.Context(), rt.ID, time.Now())
+	if err != nil {
+		writeError(w, r, internalError("could not use refresh token", err))
+		return
+	}
+	if !fresh {
+		log.Printf("refresh token reused, revoking family %s of user %s\n", rt.FamilyID, rt.UserID)
+		err = tokenStore.RevokeTokenFamily(r.Context(), rt.FamilyID)
+		if err != nil {
+			log.Printf("could not revoke token family: %s\n", err)
+		}
+		writeError(w, r, errInvalidRefreshToken)
+		return
+	}
+
+	// Reload the user so name and scope changes reach the new access token.
+	user, err := userStore.GetUser(r.Context(), rt.UserID)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		writeError(w, r, internalError("could not find user", err))
+		return
+	}
+	if err != nil {
+		log.Printf("could not find user: %s\n", err)
+		writeError(w, r, errInvalidRefreshToken)
+		return
+	}
+
+	writeTokens(w, r, user, rt.FamilyID)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func decodeTokens(t *testing.T, w *httptest.ResponseRecorder) *TokenResponse {
+	t.Helper()
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	tr := &TokenResponse{}
+	err := json.NewDecoder(w.Body).Decode(tr)
+	if err != nil {
+		t.Fatalf("Error decoding response: %s\n", err)
+	}
+	if tr.Token == "" || tr.RefreshToken == "" {
+		t.Fatalf("Expected both tokens, got %+v", tr)
+	}
+	return tr
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	setupStores(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	createTestUser(t, &User{ID: "alice", Username: "alice", Password: string(hash)})
+
+	login := decodeTokens(t, send(t, nil, "POST", "/api/v1/login", `{"username":"alice","password":"secret"}`))
+
+	// Refreshing rotates the refresh token
+	first := decodeTokens(t, send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"`+login.RefreshToken+`"}`))
+	if first.RefreshToken == login.RefreshToken {
+		t.Errorf("Expected a new refresh token")
+	}
+
+	// Replaying the old token fails and revokes the family
+	w := send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"`+login.RefreshToken+`"}`)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 on reuse, got %d", w.Code)
+	}
+	w = send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"`+first.RefreshToken+`"}`)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 after family revocation, got %d", w.Code)
+	}
+
+	// A new login starts a new family
+	login = decodeTokens(t, send(t, nil, "POST", "/api/v1/login", `{"username":"alice","password":"secret"}`))
+	decodeTokens(t, send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"`+login.RefreshToken+`"}`))
+
+	w = send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"bogus"}`)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 for unknown token, got %d", w.Code)
+	}
+}
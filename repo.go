@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
 
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// getMongoClient connects to the MongoDB at mongo.prod, which must be a
+// replica set or sharded cluster, see checkTransactions.
 func getMongoClient(ctx context.Context) (*mongo.Client, error) {
 	mongoURL := viper.GetString("mongo.prod")
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
@@ -22,6 +30,21 @@ func getMongoClient(ctx context.Context) (*mongo.Client, error) {
 	return client, nil
 }
 
+// checkTransactions makes sure the server behind client supports the
+// transactions tag renames, merges and deletes run in. Standalone servers
+// don't, only replica sets and sharded clusters do.
+func checkTransactions(ctx context.Context, client *mongo.Client) error {
+	hello := bson.M{}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return err
+	}
+	if _, ok := hello["setName"]; ok || hello["msg"] == "isdbgrid" {
+		return nil
+	}
+	return errors.New("MongoDB must run as a replica set or sharded cluster to support transactions, a single-node replica set will do")
+}
+
 func getUsersCollection(client *mongo.Client) *mongo.Collection {
 	return client.Database(viper.GetString("mongo.db")).Collection("users")
 }
@@ -29,3 +52,878 @@ func getUsersCollection(client *mongo.Client) *mongo.Collection {
 func getTodosCollection(client *mongo.Client) *mongo.Collection {
 	return client.Database(viper.GetString("mongo.db")).Collection("todos")
 }
+
+func getTagsCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(viper.GetString("mongo.db")).Collection("tags")
+}
+
+func getCommentsCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(viper.GetString("mongo.db")).Collection("comments")
+}
+
+func getRefreshTokensCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(viper.GetString("mongo.db")).Collection("refresh_tokens")
+}
+
+func getRevocationsCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(viper.GetString("mongo.db")).Collection("revocations")
+}
+
+type mongoTodoStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoTodoStore(client *mongo.Client) *mongoTodoStore {
+	return &mongoTodoStore{coll: getTodosCollection(client)}
+}
+
+// migrate moves todos that still embed their owner document over to an
+// ownerId reference, and fills in fields added since.
+func (s *mongoTodoStore) migrate(ctx context.Context) error {
+	res, err := s.coll.UpdateMany(
+		ctx,
+		bson.M{"ownerId": bson.M{"$exists": false}, "owner._id": bson.M{"$exists": true}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"ownerId": "$owner._id"}}},
+			{{Key: "$unset", Value: "owner"}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("migrated %d todos to ownerId\n", res.ModifiedCount)
+	}
+
+	// Fill in fields added since. Todos from before manual ordering sort
+	// first, and get positions of their own the first time one of them is
+	// moved.
+	defaults := bson.D{{Key: "position", Value: ""}, {Key: "priority", Value: 0}, {Key: "tags", Value: bson.A{}}}
+	for _, field := range defaults {
+		res, err = s.coll.UpdateMany(
+			ctx,
+			bson.M{field.Key: bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{field.Key: field.Value}},
+		)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount > 0 {
+			log.Printf("set %s on %d todos\n", field.Key, res.ModifiedCount)
+		}
+	}
+	return nil
+}
+
+// setMissingVersions gives records written before versioning version 1, so
+// conditional writes can match them.
+func setMissingVersions(ctx context.Context, coll *mongo.Collection) error {
+	res, err := coll.UpdateMany(
+		ctx,
+		bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 1}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("set the version of %d records in %s\n", res.ModifiedCount, coll.Name())
+	}
+	return nil
+}
+
+// versionFilter matches the record with id at version, or at any version if
+// version is 0.
+func versionFilter(id string, version int64) bson.M {
+	filter := bson.M{"_id": id}
+	if version != 0 {
+		filter["version"] = version
+	}
+	return filter
+}
+
+// writeMissed explains why a conditional write on id matched nothing: either
+// the record is gone, or it has moved on to another version.
+func writeMissed(ctx context.Context, coll *mongo.Collection, kind, id string, notFound error) error {
+	n, err := coll.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s %s: %w", kind, id, notFound)
+	}
+	return fmt.Errorf("%s %s: %w", kind, id, ErrVersionConflict)
+}
+
+// createIndexes backs the owner-scoped listings of GET /api/v1/todos for
+// each sort order.
+func (s *mongoTodoStore) createIndexes(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "title", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "priority", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "position", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "dueAt", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "parentId", Value: 1}, {Key: "position", Value: 1}}},
+		{Keys: bson.D{{Key: "blockedBy", Value: 1}}},
+	})
+	return err
+}
+
+// todoQuery translates filter into a MongoDB query.
+func todoQuery(filter TodoFilter) bson.M {
+	query := bson.M{}
+	if filter.OwnerID != "" {
+		query["ownerId"] = filter.OwnerID
+	}
+	if filter.ParentID != "" {
+		query["parentId"] = filter.ParentID
+	}
+	if filter.BlockedBy != "" {
+		query["blockedBy"] = filter.BlockedBy
+	}
+	if len(filter.Statuses) > 0 {
+		query["status"] = bson.M{"$in": filter.Statuses}
+	}
+	if filter.Text != "" {
+		query["title"] = bson.M{"$regex": regexp.QuoteMeta(filter.Text), "$options": "i"}
+	}
+	ranges := []struct {
+		field         string
+		after, before time.Time
+	}{
+		{"createdAt", filter.CreatedAfter, filter.CreatedBefore},
+		{"updatedAt", filter.UpdatedAfter, filter.UpdatedBefore},
+		{"dueAt", filter.DueAfter, filter.DueBefore},
+	}
+	for _, rng := range ranges {
+		cond := bson.M{}
+		if !rng.after.IsZero() {
+			cond["$gte"] = rng.after
+		}
+		if !rng.before.IsZero() {
+			cond["$lt"] = rng.before
+		}
+		if len(cond) > 0 {
+			query[rng.field] = cond
+		}
+	}
+	if filter.Incomplete {
+		query["completedAt"] = nil
+	}
+	tags := bson.M{}
+	if len(filter.TagsAny) > 0 {
+		tags["$in"] = filter.TagsAny
+	}
+	if len(filter.TagsAll) > 0 {
+		tags["$all"] = filter.TagsAll
+	}
+	if len(filter.TagsNone) > 0 {
+		tags["$nin"] = filter.TagsNone
+	}
+	if len(tags) > 0 {
+		query["tags"] = tags
+	}
+	if filter.After != nil {
+		// Keyset pagination: everything strictly after (sort key, _id).
+		op := "$gt"
+		if filter.Sort.Desc {
+			op = "$lt"
+		}
+		var key interface{} = filter.After.Time
+		switch filter.Sort.Field {
+		case sortTitle:
+			key = filter.After.Title
+		case sortPriority:
+			key = filter.After.Priority
+		case sortPosition:
+			key = filter.After.Position
+		}
+		query["$or"] = bson.A{
+			bson.M{filter.Sort.Field: bson.M{op: key}},
+			bson.M{filter.Sort.Field: key, "_id": bson.M{op: filter.After.ID}},
+		}
+	}
+	return query
+}
+
+func (s *mongoTodoStore) ListTodos(ctx context.Context, filter TodoFilter) ([]*Todo, error) {
+	dir := 1
+	if filter.Sort.Desc {
+		dir = -1
+	}
+	sort := bson.D{{Key: "_id", Value: dir}}
+	if filter.Sort.Field != "" {
+		sort = append(bson.D{{Key: filter.Sort.Field, Value: dir}}, sort...)
+	}
+	opts := options.Find().SetSort(sort)
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := s.coll.Find(ctx, todoQuery(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	todos := []*Todo{}
+	for cursor.Next(ctx) {
+		todo := &Todo{}
+		err := cursor.Decode(todo)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+func (s *mongoTodoStore) GetTodo(ctx context.Context, id string) (*Todo, error) {
+	todo := &Todo{}
+	err := s.coll.FindOne(ctx, bson.M{"_id": id}).Decode(todo)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("todo %s: %w", id, ErrTodoNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return todo, nil
+}
+
+func (s *mongoTodoStore) CreateTodo(ctx context.Context, todo *Todo) error {
+	_, err := s.coll.InsertOne(ctx, todo)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("todo %s: %w", todo.ID, ErrDuplicate)
+	}
+	return err
+}
+
+func (s *mongoTodoStore) UpdateTodo(ctx context.Context, id string, todo *Todo) error {
+	version := todo.Version
+	todo.Version++
+	res, err := s.coll.ReplaceOne(ctx, bson.M{"_id": id, "version": version}, todo)
+	if err == nil && res.MatchedCount == 0 {
+		err = writeMissed(ctx, s.coll, "todo", id, ErrTodoNotFound)
+	}
+	if err != nil {
+		todo.Version = version
+		return err
+	}
+	return nil
+}
+
+func (s *mongoTodoStore) DeleteTodo(ctx context.Context, id string, version int64) error {
+	res, err := s.coll.DeleteOne(ctx, versionFilter(id, version))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return writeMissed(ctx, s.coll, "todo", id, ErrTodoNotFound)
+	}
+	return nil
+}
+
+func (s *mongoTodoStore) DeleteTodosByOwner(ctx context.Context, ownerID string) error {
+	_, err := s.coll.DeleteMany(ctx, bson.M{"ownerId": ownerID})
+	return err
+}
+
+func (s *mongoTodoStore) CountSubtasks(ctx context.Context, parentIDs []string) (map[string]*Progress, error) {
+	cursor, err := s.coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"parentId": bson.M{"$in": parentIDs}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$parentId",
+			"total": bson.M{"$sum": 1},
+			"done":  bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$ifNull": bson.A{"$completedAt", false}}, 1, 0}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	progress := map[string]*Progress{}
+	for cursor.Next(ctx) {
+		var row struct {
+			ParentID string `bson:"_id"`
+			Total    int    `bson:"total"`
+			Done     int    `bson:"done"`
+		}
+		err := cursor.Decode(&row)
+		if err != nil {
+			return nil, err
+		}
+		progress[row.ParentID] = &Progress{Done: row.Done, Total: row.Total}
+	}
+	return progress, cursor.Err()
+}
+
+func (s *mongoTodoStore) RemoveBlocker(ctx context.Context, id string) error {
+	_, err := s.coll.UpdateMany(
+		ctx,
+		bson.M{"blockedBy": id},
+		bson.M{"$pull": bson.M{"blockedBy": id}, "$inc": bson.M{"version": 1}},
+	)
+	return err
+}
+
+func (s *mongoTodoStore) SetTodoPositions(ctx context.Context, positions map[string]string) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	writes := []mongo.WriteModel{}
+	for id, position := range positions {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$set": bson.M{"position": position}, "$inc": bson.M{"version": 1}}))
+	}
+	_, err := s.coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *mongoTodoStore) TouchTodos(ctx context.Context, ids []string) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$inc": bson.M{"version": 1}})
+	return err
+}
+
+type mongoTagStore struct {
+	client *mongo.Client
+	coll   *mongo.Collection
+	todos  *mongo.Collection
+}
+
+func newMongoTagStore(client *mongo.Client) *mongoTagStore {
+	return &mongoTagStore{client: client, coll: getTagsCollection(client), todos: getTodosCollection(client)}
+}
+
+// createIndexes makes tag names unique per owner.
+func (s *mongoTagStore) createIndexes(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "ownerId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("owner_name_unique").SetUnique(true),
+	})
+	return err
+}
+
+// inTransaction runs fn in a transaction, which needs MongoDB to run as a
+// replica set. openStores checks for that with checkTransactions.
+func (s *mongoTagStore) inTransaction(ctx context.Context, fn func(ctx mongo.SessionContext) error) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// retag replaces the tag from with to on ownerID's todos, or takes it off if
+// to is empty.
+func (s *mongoTagStore) retag(ctx context.Context, ownerID, from, to string) error {
+	pull := bson.M{"$pull": bson.M{"tags": from}, "$inc": bson.M{"version": 1}}
+	if to == "" {
+		_, err := s.todos.UpdateMany(ctx, bson.M{"ownerId": ownerID, "tags": from}, pull)
+		return err
+	}
+	// Todos that already have to only lose from.
+	_, err := s.todos.UpdateMany(ctx, bson.M{"ownerId": ownerID, "tags": bson.M{"$all": bson.A{from, to}}}, pull)
+	if err != nil {
+		return err
+	}
+	_, err = s.todos.UpdateMany(
+		ctx,
+		bson.M{"ownerId": ownerID, "tags": from},
+		bson.M{"$set": bson.M{"tags.$": to}, "$inc": bson.M{"version": 1}},
+	)
+	return err
+}
+
+func (s *mongoTagStore) ListTags(ctx context.Context, ownerID string) ([]*Tag, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := s.coll.Find(ctx, bson.M{"ownerId": ownerID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	tags := []*Tag{}
+	err = cursor.All(ctx, &tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (s *mongoTagStore) GetTag(ctx context.Context, id string) (*Tag, error) {
+	tag := &Tag{}
+	err := s.coll.FindOne(ctx, bson.M{"_id": id}).Decode(tag)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("tag %s: %w", id, ErrTagNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (s *mongoTagStore) CreateTag(ctx context.Context, tag *Tag) error {
+	_, err := s.coll.InsertOne(ctx, tag)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("tag %s: name %s: %w", tag.ID, tag.Name, ErrDuplicate)
+	}
+	return err
+}
+
+func (s *mongoTagStore) UpdateTag(ctx context.Context, id string, tag *Tag) error {
+	version := tag.Version
+	err := s.inTransaction(ctx, func(ctx mongo.SessionContext) error {
+		stored, err := s.GetTag(ctx, id)
+		if err != nil {
+			return err
+		}
+		if stored.Version != version {
+			return fmt.Errorf("tag %s: %w", id, ErrVersionConflict)
+		}
+		tag.Version = version + 1
+		_, err = s.coll.ReplaceOne(ctx, bson.M{"_id": id, "version": version}, tag)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("tag %s: name %s: %w", id, tag.Name, ErrDuplicate)
+		}
+		if err != nil || tag.Name == stored.Name {
+			return err
+		}
+		return s.retag(ctx, stored.OwnerID, stored.Name, tag.Name)
+	})
+	if err != nil {
+		tag.Version = version
+	}
+	return err
+}
+
+func (s *mongoTagStore) MergeTag(ctx context.Context, from, into *Tag) error {
+	return s.inTransaction(ctx, func(ctx mongo.SessionContext) error {
+		target, err := s.GetTag(ctx, into.ID)
+		if err != nil {
+			return err
+		}
+		res, err := s.coll.DeleteOne(ctx, bson.M{"_id": from.ID, "version": from.Version})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			return writeMissed(ctx, s.coll, "tag", from.ID, ErrTagNotFound)
+		}
+		return s.retag(ctx, from.OwnerID, from.Name, target.Name)
+	})
+}
+
+func (s *mongoTagStore) DeleteTag(ctx context.Context, id string, version int64) error {
+	return s.inTransaction(ctx, func(ctx mongo.SessionContext) error {
+		stored, err := s.GetTag(ctx, id)
+		if err != nil {
+			return err
+		}
+		res, err := s.coll.DeleteOne(ctx, versionFilter(id, version))
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			return writeMissed(ctx, s.coll, "tag", id, ErrTagNotFound)
+		}
+		return s.retag(ctx, stored.OwnerID, stored.Name, "")
+	})
+}
+
+func (s *mongoTagStore) DeleteTagsByOwner(ctx context.Context, ownerID string) error {
+	_, err := s.coll.DeleteMany(ctx, bson.M{"ownerId": ownerID})
+	return err
+}
+
+func (s *mongoTagStore) EnsureTags(ctx context.Context, ownerID string, names []string) error {
+	for _, name := range names {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		_, err = s.coll.UpdateOne(
+			ctx,
+			bson.M{"ownerId": ownerID, "name": name},
+			bson.M{"$setOnInsert": bson.M{"_id": id, "createdAt": currentTime(), "version": 1}},
+			options.Update().SetUpsert(true),
+		)
+		// A concurrent upsert of the same tag may win the race.
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoTagStore) CountTags(ctx context.Context, ownerID string) (map[string]int, error) {
+	cursor, err := s.todos.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"ownerId": ownerID}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	counts := map[string]int{}
+	for cursor.Next(ctx) {
+		var row struct {
+			Name  string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		err := cursor.Decode(&row)
+		if err != nil {
+			return nil, err
+		}
+		counts[row.Name] = row.Count
+	}
+	return counts, cursor.Err()
+}
+
+type mongoCommentStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoCommentStore(client *mongo.Client) *mongoCommentStore {
+	return &mongoCommentStore{coll: getCommentsCollection(client)}
+}
+
+// createIndexes backs the listing of a todo's comments.
+func (s *mongoCommentStore) createIndexes(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "todoId", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	return err
+}
+
+func (s *mongoCommentStore) ListComments(ctx context.Context, todoID string) ([]*Comment, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.coll.Find(ctx, bson.M{"todoId": todoID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	comments := []*Comment{}
+	err = cursor.All(ctx, &comments)
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (s *mongoCommentStore) GetComment(ctx context.Context, id string) (*Comment, error) {
+	comment := &Comment{}
+	err := s.coll.FindOne(ctx, bson.M{"_id": id}).Decode(comment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("comment %s: %w", id, ErrCommentNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+func (s *mongoCommentStore) CreateComment(ctx context.Context, comment *Comment) error {
+	_, err := s.coll.InsertOne(ctx, comment)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("comment %s: %w", comment.ID, ErrDuplicate)
+	}
+	return err
+}
+
+func (s *mongoCommentStore) UpdateComment(ctx context.Context, id string, comment *Comment) error {
+	version := comment.Version
+	comment.Version++
+	res, err := s.coll.ReplaceOne(ctx, bson.M{"_id": id, "version": version}, comment)
+	if err == nil && res.MatchedCount == 0 {
+		err = writeMissed(ctx, s.coll, "comment", id, ErrCommentNotFound)
+	}
+	if err != nil {
+		comment.Version = version
+		return err
+	}
+	return nil
+}
+
+func (s *mongoCommentStore) DeleteComment(ctx context.Context, id string, version int64) error {
+	res, err := s.coll.DeleteOne(ctx, versionFilter(id, version))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return writeMissed(ctx, s.coll, "comment", id, ErrCommentNotFound)
+	}
+	return nil
+}
+
+func (s *mongoCommentStore) DeleteCommentsByTodos(ctx context.Context, todoIDs []string) error {
+	_, err := s.coll.DeleteMany(ctx, bson.M{"todoId": bson.M{"$in": todoIDs}})
+	return err
+}
+
+type mongoUserStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoUserStore(client *mongo.Client) *mongoUserStore {
+	return &mongoUserStore{coll: getUsersCollection(client)}
+}
+
+// createIndexes backs the username-ordered listing of GET /api/v1/users and
+// its scope filter.
+func (s *mongoUserStore) createIndexes(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "scope", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// Users created before usernames were required may have none, so only
+	// non-empty usernames have to be unique.
+	_, err = s.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().
+			SetName("username_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"username": bson.M{"$gt": ""}}),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create unique username index, remove duplicate usernames first: %w", err)
+	}
+	return nil
+}
+
+// userQuery translates filter into a MongoDB query.
+func userQuery(filter UserFilter) bson.M {
+	query := bson.M{}
+	and := bson.A{}
+	if filter.Prefix != "" {
+		prefix := bson.M{"$regex": "^" + regexp.QuoteMeta(filter.Prefix), "$options": "i"}
+		and = append(and, bson.M{"$or": bson.A{bson.M{"name": prefix}, bson.M{"username": prefix}}})
+	}
+	if filter.Scope != "" {
+		query["scope"] = filter.Scope
+	}
+	if filter.After != nil {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"username": bson.M{"$gt": filter.After.Username}},
+			bson.M{"username": filter.After.Username, "_id": bson.M{"$gt": filter.After.ID}},
+		}})
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	return query
+}
+
+func (s *mongoUserStore) ListUsers(ctx context.Context, filter UserFilter) ([]*User, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: 1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := s.coll.Find(ctx, userQuery(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	users := []*User{}
+	for cursor.Next(ctx) {
+		user := &User{}
+		err := cursor.Decode(user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *mongoUserStore) GetUser(ctx context.Context, id string) (*User, error) {
+	user := &User{}
+	err := s.coll.FindOne(ctx, bson.M{"_id": id}).Decode(user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("user %s: %w", id, ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *mongoUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	user := &User{}
+	err := s.coll.FindOne(ctx, bson.M{"username": username}).Decode(user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("user %s: %w", username, ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *mongoUserStore) CreateUser(ctx context.Context, user *User) error {
+	_, err := s.coll.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("user %s: username %s: %w", user.ID, user.Username, ErrDuplicate)
+	}
+	return err
+}
+
+func (s *mongoUserStore) UpdateUser(ctx context.Context, id string, user *User) error {
+	version := user.Version
+	user.Version++
+	res, err := s.coll.ReplaceOne(ctx, bson.M{"_id": id, "version": version}, user)
+	if mongo.IsDuplicateKeyError(err) {
+		err = fmt.Errorf("user %s: username %s: %w", id, user.Username, ErrDuplicate)
+	} else if err == nil && res.MatchedCount == 0 {
+		err = writeMissed(ctx, s.coll, "user", id, ErrUserNotFound)
+	}
+	if err != nil {
+		user.Version = version
+		return err
+	}
+	return nil
+}
+
+func (s *mongoUserStore) DeleteUser(ctx context.Context, id string, version int64) error {
+	res, err := s.coll.DeleteOne(ctx, versionFilter(id, version))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return writeMissed(ctx, s.coll, "user", id, ErrUserNotFound)
+	}
+	return nil
+}
+
+type mongoTokenStore struct {
+	refreshTokens *mongo.Collection
+	revocations   *mongo.Collection
+}
+
+func newMongoTokenStore(client *mongo.Client) *mongoTokenStore {
+	return &mongoTokenStore{
+		refreshTokens: getRefreshTokensCollection(client),
+		revocations:   getRevocationsCollection(client),
+	}
+}
+
+// createIndexes adds TTL indexes so MongoDB prunes expired refresh tokens
+// and revocations by itself.
+func (s *mongoTokenStore) createIndexes(ctx context.Context) error {
+	expiry := mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err := s.refreshTokens.Indexes().CreateOne(ctx, expiry)
+	if err != nil {
+		return err
+	}
+	_, err = s.refreshTokens.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"userId": 1}})
+	if err != nil {
+		return err
+	}
+	_, err = s.revocations.Indexes().CreateOne(ctx, expiry)
+	return err
+}
+
+func (s *mongoTokenStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	_, err := s.refreshTokens.InsertOne(ctx, token)
+	return err
+}
+
+func (s *mongoTokenStore) GetRefreshToken(ctx context.Context, id string) (*RefreshToken, error) {
+	token := &RefreshToken{}
+	err := s.refreshTokens.FindOne(ctx, bson.M{"_id": id}).Decode(token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("refresh token %s: %w", id, ErrRefreshTokenNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *mongoTokenStore) UseRefreshToken(ctx context.Context, id string, at time.Time) (bool, error) {
+	res, err := s.refreshTokens.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "usedAt": nil},
+		bson.M{"$set": bson.M{"usedAt": at}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (s *mongoTokenStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	_, err := s.refreshTokens.UpdateMany(
+		ctx,
+		bson.M{"familyId": familyID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	return err
+}
+
+func (s *mongoTokenStore) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	_, err := s.refreshTokens.UpdateMany(
+		ctx,
+		bson.M{"userId": userID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	return err
+}
+
+func (s *mongoTokenStore) Revoke(ctx context.Context, rev *Revocation) error {
+	// MongoDB keeps milliseconds. Rounding up keeps tokens issued in the
+	// revocation's last millisecond revoked.
+	stored := *rev
+	if truncated := rev.RevokedAt.Truncate(time.Millisecond); !truncated.Equal(rev.RevokedAt) {
+		stored.RevokedAt = truncated.Add(time.Millisecond)
+	}
+	_, err := s.revocations.ReplaceOne(
+		ctx,
+		bson.M{"_id": rev.ID},
+		&stored,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoTokenStore) IsRevoked(ctx context.Context, claims *TodoClaims) (bool, error) {
+	ids := []string{tokenRevocationID(claims.RegisteredClaims.ID), userRevocationID(claims.ID)}
+	cursor, err := s.revocations.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		rev := &Revocation{}
+		err := cursor.Decode(rev)
+		if err != nil {
+			return false, err
+		}
+		if isRevokedBy(rev, claims) {
+			return true, nil
+		}
+	}
+	return false, cursor.Err()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// Revocation invalidates access tokens before they expire. A revocation either
+// names a single token by its jti, or cuts off every token a user was issued
+// before RevokedAt. Entries are only needed until the tokens they cover would
+// have expired anyway, after which the store prunes them.
+type Revocation struct {
+	ID        string    `json:"id" bson:"_id"`
+	RevokedAt time.Time `json:"revokedAt" bson:"revokedAt"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+func tokenRevocationID(jti string) string {
+	return "jti:" + jti
+}
+
+func userRevocationID(userID string) string {
+	return "user:" + userID
+}
+
+// isRevokedBy reports whether rev covers the token described by claims.
+func isRevokedBy(rev *Revocation, claims *TodoClaims) bool {
+	if rev.ID == tokenRevocationID(claims.RegisteredClaims.ID) {
+		return true
+	}
+	if rev.ID == userRevocationID(claims.ID) {
+		// Tokens without iatn only say which second they were issued in,
+		// so those from the second of the revocation are revoked too.
+		if claims.IssuedAtNano != 0 {
+			return claims.IssuedAtNano <= rev.RevokedAt.UnixNano()
+		}
+		return claims.IssuedAt == nil || !claims.IssuedAt.Time.After(rev.RevokedAt)
+	}
+	return false
+}
+
+type LogoutRequest struct {
+	// RefreshToken, if set, is revoked along with the rest of its family.
+	RefreshToken string `json:"refreshToken"`
+	// All logs out every session of the user.
+	All bool `json:"all"`
+}
+
+// revokeUserSessions revokes every access and refresh token issued to userID
+// so far.
+func revokeUserSessions(r *http.Request, userID string) error {
+	now := time.Now()
+	err := tokenStore.Revoke(r.Context(), &Revocation{
+		ID:        userRevocationID(userID),
+		RevokedAt: now,
+		ExpiresAt: now.Add(viper.GetDuration("token.access_ttl")),
+	})
+	if err != nil {
+		return err
+	}
+	return tokenStore.RevokeUserRefreshTokens(r.Context(), userID)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	log.Println("Logging out...")
+	lr := &LogoutRequest{}
+	err := json.NewDecoder(r.Body).Decode(lr)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, badRequest("could not decode logout request", err))
+		return
+	}
+
+	claims := claimsFromContext(r.Context())
+	if lr.All {
+		err = revokeUserSessions(r, claims.ID)
+		if err != nil {
+			writeError(w, r, internalError("could not revoke sessions", err))
+			return
+		}
+	}
+
+	err = tokenStore.Revoke(r.Context(), &Revocation{
+		ID:        tokenRevocationID(claims.RegisteredClaims.ID),
+		RevokedAt: time.Now(),
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		writeError(w, r, internalError("could not revoke token", err))
+		return
+	}
+
+	if lr.RefreshToken != "" {
+		rt, err := tokenStore.GetRefreshToken(r.Context(), hashRefreshToken(lr.RefreshToken))
+		if err == nil && rt.UserID == claims.ID {
+			err = tokenStore.RevokeTokenFamily(r.Context(), rt.FamilyID)
+			if err != nil {
+				writeError(w, r, internalError("could not revoke refresh token", err))
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logoutUser logs out every session of the user in the URL.
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	log.Println("Logging out user...")
+	params := mux.Vars(r)
+	userID := params["userID"]
+	if userID == "" {
+		writeError(w, r, errUserIDRequired)
+		return
+	}
+	user, err := userStore.GetUser(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, storeError("could not find user", err))
+		return
+	}
+	if !checkUserEdit(w, r, user) {
+		return
+	}
+
+	err = revokeUserSessions(r, userID)
+	if err != nil {
+		writeError(w, r, internalError("could not revoke sessions", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
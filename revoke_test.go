@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLogout(t *testing.T) {
+	setupStores(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	createTestUser(t, &User{ID: "alice", Username: "alice", Password: string(hash), Scope: []string{scopeTodosRead}})
+	credentials := `{"username":"alice","password":"secret"}`
+
+	// Logging out revokes the access token and the refresh token
+	session := decodeTokens(t, send(t, nil, "POST", "/api/v1/login", credentials))
+	other := decodeTokens(t, send(t, nil, "POST", "/api/v1/login", credentials))
+	w := send(t, nil, "POST", "/api/v1/logout", `{"refreshToken":"`+session.RefreshToken+`"}`, "Authorization", "Bearer "+session.Token)
+	if w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d", w.Code)
+	}
+	w = send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+session.Token)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 for revoked token, got %d", w.Code)
+	}
+	w = send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"`+session.RefreshToken+`"}`)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 for revoked refresh token, got %d", w.Code)
+	}
+
+	// Other sessions are unaffected
+	w = send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+other.Token)
+	if w.Code != 200 {
+		t.Errorf("Expected status code 200 for other session, got %d", w.Code)
+	}
+
+	// Logging out everywhere revokes every session
+	w = send(t, nil, "POST", "/api/v1/logout", `{"all":true}`, "Authorization", "Bearer "+other.Token)
+	if w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d", w.Code)
+	}
+	w = send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+other.Token)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 after logging out everywhere, got %d", w.Code)
+	}
+	w = send(t, nil, "POST", "/api/v1/token/refresh", `{"refreshToken":"`+other.RefreshToken+`"}`)
+	if w.Code != 401 {
+		t.Errorf("Expected status code 401 after logging out everywhere, got %d", w.Code)
+	}
+
+	// Logging back in right away works, even within the same second
+	fresh := decodeTokens(t, send(t, nil, "POST", "/api/v1/login", credentials))
+	w = send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+fresh.Token)
+	if w.Code != 200 {
+		t.Errorf("Expected status code 200 after logging back in, got %d", w.Code)
+	}
+
+	// The same goes after an admin logs the user out
+	w = send(t, testAdmin, "POST", "/api/v1/users/alice/logout", "")
+	if w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+	fresh = decodeTokens(t, send(t, nil, "POST", "/api/v1/login", credentials))
+	w = send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+fresh.Token)
+	if w.Code != 200 {
+		t.Errorf("Expected status code 200 after logging back in, got %d", w.Code)
+	}
+}
+
+func TestRevocationsWithinASecond(t *testing.T) {
+	setupStores(t)
+	alice := &User{ID: "alice", Username: "alice", Scope: []string{scopeTodosRead}}
+	createTestUser(t, alice)
+	second := time.Now().Truncate(time.Second).Add(-time.Minute)
+	tokenStore.Revoke(context.Background(), &Revocation{
+		ID:        userRevocationID("alice"),
+		RevokedAt: second.Add(500 * time.Millisecond),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	// Tokens minted in the revocation's second are revoked unless minted
+	// after it; without iatn they can't tell, so they are revoked too.
+	tests := []struct {
+		issuedAtNano int64
+		status       int
+	}{
+		{second.Add(100 * time.Millisecond).UnixNano(), 401},
+		{second.Add(700 * time.Millisecond).UnixNano(), 200},
+		{0, 401},
+	}
+	for _, tt := range tests {
+		claims := &TodoClaims{
+			ID:           alice.ID,
+			Scope:        alice.Scope,
+			IssuedAtNano: tt.issuedAtNano,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "jti",
+				IssuedAt:  jwt.NewNumericDate(second),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				Issuer:    "todose",
+			},
+		}
+		token, err := keyRing.Sign(jwt.NewWithClaims(jwt.SigningMethodRS256, claims))
+		if err != nil {
+			t.Fatalf("Error signing token: %s\n", err)
+		}
+		if w := send(t, nil, "GET", "/api/v1/todos", "", "Authorization", "Bearer "+token); w.Code != tt.status {
+			t.Errorf("Token issued at %d: expected status code %d, got %d", tt.issuedAtNano, tt.status, w.Code)
+		}
+	}
+}
+
+func TestMemoryTokenStorePrunesRevocations(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryTokenStore()
+	now := time.Now()
+	store.Revoke(ctx, &Revocation{ID: tokenRevocationID("old"), RevokedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)})
+	store.Revoke(ctx, &Revocation{ID: tokenRevocationID("new"), RevokedAt: now, ExpiresAt: now.Add(time.Minute)})
+	if len(store.revocations) != 1 {
+		t.Errorf("Expected expired revocation to be pruned, got %d revocations", len(store.revocations))
+	}
+}
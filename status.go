@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TodoStatus is a state in the todo workflow.
+type TodoStatus string
+
+const (
+	StatusNew     TodoStatus = "new"
+	StatusStarted TodoStatus = "started"
+	StatusDone    TodoStatus = "done"
+)
+
+// Workflow is the graph of allowed status transitions. It is read from
+// todos.initial_status and todos.transitions in the settings file.
+type Workflow struct {
+	Initial     TodoStatus
+	Transitions map[TodoStatus][]TodoStatus
+}
+
+var workflow *Workflow
+
+func loadWorkflow() (*Workflow, error) {
+	transitions := map[string][]string{}
+	err := viper.UnmarshalKey("todos.transitions", &transitions)
+	if err != nil {
+		return nil, err
+	}
+	wf := &Workflow{
+		Initial:     TodoStatus(viper.GetString("todos.initial_status")),
+		Transitions: map[TodoStatus][]TodoStatus{},
+	}
+	for from, tos := range transitions {
+		for _, to := range tos {
+			wf.Transitions[TodoStatus(from)] = append(wf.Transitions[TodoStatus(from)], TodoStatus(to))
+		}
+	}
+	if !wf.Known(wf.Initial) {
+		return nil, fmt.Errorf("initial status %s has no transitions", wf.Initial)
+	}
+	for from, tos := range wf.Transitions {
+		for _, to := range tos {
+			if !wf.Known(to) {
+				return nil, fmt.Errorf("transition %s -> %s leads to a status with no transitions", from, to)
+			}
+		}
+	}
+	return wf, nil
+}
+
+// Known reports whether status is part of the workflow.
+func (wf *Workflow) Known(status TodoStatus) bool {
+	_, ok := wf.Transitions[status]
+	return ok
+}
+
+// CanTransition reports whether a todo may move from one status to another.
+func (wf *Workflow) CanTransition(from, to TodoStatus) bool {
+	for _, next := range wf.Transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setStatus moves todo to status and records when work started and
+// finished. Going back to an earlier status clears the later timestamps.
+func setStatus(todo *Todo, status TodoStatus, at time.Time) {
+	todo.Status = status
+	switch status {
+	case StatusStarted:
+		todo.StartedAt = &at
+		todo.CompletedAt = nil
+	case StatusDone:
+		if todo.StartedAt == nil {
+			todo.StartedAt = &at
+		}
+		todo.CompletedAt = &at
+	case workflow.Initial:
+		todo.StartedAt = nil
+		todo.CompletedAt = nil
+	}
+}
+
+// checkTransition writes a 422 response and returns false if todo can't
+// move from its current status to status.
+func checkTransition(w http.ResponseWriter, r *http.Request, todo *Todo, status TodoStatus) bool {
+	if todo.Status == status {
+		return true
+	}
+	if !workflow.Known(status) {
+		writeError(w, r, validationFailed(FieldError{Field: "status", Code: "invalid_status", Message: "unknown status " + string(status)}))
+		return false
+	}
+	if !workflow.CanTransition(todo.Status, status) {
+		writeError(w, r, validationFailed(FieldError{Field: "status", Code: "invalid_transition", Message: fmt.Sprintf("cannot move todo from %s to %s", todo.Status, status)}))
+		return false
+	}
+	return true
+}
+
+type TransitionRequest struct {
+	To TodoStatus `json:"to"`
+}
+
+// transitionTodo moves a todo to another status along the workflow. Moving
+// to done deals with open blockers and subtasks as checkUnblocked and
+// openSubtasks say, and schedules the next occurrence of a recurring
+// todo.
+func transitionTodo(w http.ResponseWriter, r *http.Request) {
+	log.Println("Transitioning todo...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil || !checkIfMatch(w, r, todo.Version) {
+		return
+	}
+	tr := &TransitionRequest{}
+	err := json.NewDecoder(r.Body).Decode(tr)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode transition", err))
+		return
+	}
+	if todo.Status == tr.To {
+		writeError(w, r, validationFailed(FieldError{Field: "to", Code: "invalid_transition", Message: "todo is already " + string(tr.To)}))
+		return
+	}
+	if !checkTransition(w, r, todo, tr.To) {
+		return
+	}
+
+	now := currentTime()
+	var open []*Todo
+	if tr.To == StatusDone {
+		var ok bool
+		if !checkUnblocked(w, r, todo) {
+			return
+		}
+		if open, ok = openSubtasks(w, r, todo); !ok {
+			return
+		}
+	}
+	before := *todo
+	setStatus(todo, tr.To, now)
+	todo.UpdatedAt = now
+	err = todoStore.UpdateTodo(r.Context(), todo.ID, todo)
+	if err != nil {
+		writeError(w, r, storeError("could not update todo", err))
+		return
+	}
+	// Only a completion that was stored schedules the next occurrence.
+	if tr.To == StatusDone {
+		if _, ok := scheduleNext(w, r, todo); !ok {
+			return
+		}
+	}
+	if !completeSubtasks(w, r, todo, open, now) {
+		return
+	}
+	touchParents(r.Context(), &before, todo)
+	w.Header().Set("ETag", etag(todo.Version))
+
+	writeJSON(w, r, http.StatusOK, todo)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestTodoTransitions(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	alice := &User{ID: "alice", Scope: []string{scopeTodosRead, scopeTodosWrite}}
+	createTestUser(t, alice)
+
+	// Todos start as new
+	w := send(t, alice, "POST", "/api/v1/todos", `{"title":"Chores","status":"done"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected status code 422, got %d", w.Code)
+	}
+	w = send(t, alice, "POST", "/api/v1/todos", `{"title":"Chores"}`)
+	todoID := createdID(t, w)
+
+	transition := func(to string) (int, *Todo) {
+		w := send(t, alice, "POST", "/api/v1/todos/"+todoID+"/transitions", `{"to":"`+to+`"}`)
+		todo := &Todo{}
+		json.NewDecoder(w.Body).Decode(todo)
+		return w.Code, todo
+	}
+
+	code, todo := transition("started")
+	if code != 200 || todo.Status != StatusStarted || todo.StartedAt == nil {
+		t.Errorf("Expected started with startedAt, got %d %+v", code, todo)
+	}
+	code, todo = transition("done")
+	if code != 200 || todo.Status != StatusDone || todo.CompletedAt == nil {
+		t.Errorf("Expected done with completedAt, got %d %+v", code, todo)
+	}
+	code, _ = transition("started")
+	if code != 422 {
+		t.Errorf("Expected status code 422 for done -> started, got %d", code)
+	}
+	code, _ = transition("archived")
+	if code != 422 {
+		t.Errorf("Expected status code 422 for unknown status, got %d", code)
+	}
+
+	// PUT follows the same rules
+	w = send(t, alice, "PUT", "/api/v1/todos/"+todoID, `{"title":"Chores","status":"started"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected status code 422, got %d", w.Code)
+	}
+	w = send(t, alice, "PUT", "/api/v1/todos/"+todoID, `{"title":"Chores","status":"new"}`)
+	if w.Code != 200 {
+		t.Errorf("Expected status code 200, got %d", w.Code)
+	}
+	stored, _ := todoStore.GetTodo(ctx, todoID)
+	if stored.Status != StatusNew || stored.StartedAt != nil || stored.CompletedAt != nil {
+		t.Errorf("Expected new todo without timestamps, got %+v", stored)
+	}
+}
+
+func TestWorkflowCanTransition(t *testing.T) {
+	wf := &Workflow{Initial: StatusNew, Transitions: map[TodoStatus][]TodoStatus{
+		StatusNew: {StatusDone},
+	}}
+	if wf.CanTransition(StatusDone, StatusNew) {
+		t.Errorf("Expected done -> new to be disallowed")
+	}
+	if !wf.CanTransition(StatusNew, StatusDone) {
+		t.Errorf("Expected new -> done to be allowed")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ErrDuplicate is returned when creating a record whose ID or unique key is
+// already taken.
+var ErrDuplicate = errors.New("already exists")
+
+// Stores return these, possibly wrapped, when the record to get, update or
+// delete doesn't exist.
+var (
+	ErrTodoNotFound         = errors.New("todo not found")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrTagNotFound          = errors.New("tag not found")
+	ErrCommentNotFound      = errors.New("comment not found")
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+)
+
+// ErrVersionConflict is returned when a todo or user was written by someone
+// else since it was read.
+var ErrVersionConflict = errors.New("version conflict")
+
+// newID returns a random, URL-safe ID for a new record.
+func newID() (string, error) {
+	return newRandomToken(15)
+}
+
+// currentTime is the timestamp recorded on writes. It is truncated to the
+// millisecond precision MongoDB stores.
+func currentTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// TodoFilter narrows and orders the todos returned by ListTodos. Zero fields
+// match everything.
+type TodoFilter struct {
+	OwnerID string
+	// ParentID matches the subtasks of a todo.
+	ParentID string
+	// BlockedBy matches the todos a todo blocks.
+	BlockedBy string
+	Statuses  []TodoStatus
+	// Text matches todos whose title contains it, ignoring case.
+	Text          string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// DueAfter and DueBefore only match todos with a due date.
+	DueAfter  time.Time
+	DueBefore time.Time
+	// Incomplete matches todos that haven't been completed.
+	Incomplete bool
+	// TagsAny matches todos with at least one of the tags, TagsAll todos
+	// with every one of them and TagsNone todos with none of them.
+	TagsAny  []string
+	TagsAll  []string
+	TagsNone []string
+
+	Sort TodoSort
+	// After resumes a listing after the todo the cursor points at.
+	After *TodoCursor
+	// Limit caps the number of todos returned; 0 means no limit.
+	Limit int
+}
+
+// TodoSort orders todos by Field, then by ID in the same direction so that
+// every todo has a unique position.
+type TodoSort struct {
+	Field string
+	Desc  bool
+}
+
+// Fields todos can be sorted by.
+const (
+	sortCreatedAt = "createdAt"
+	sortUpdatedAt = "updatedAt"
+	sortTitle     = "title"
+	sortPriority  = "priority"
+	sortPosition  = "position"
+)
+
+// TodoCursor is the sort key of the last todo on a page.
+type TodoCursor struct {
+	Sort     string    `json:"s"`
+	Time     time.Time `json:"t,omitempty"`
+	Title    string    `json:"v,omitempty"`
+	Priority int       `json:"n,omitempty"`
+	Position string    `json:"p,omitempty"`
+	ID       string    `json:"id"`
+}
+
+// TodoStore persists todos. GetTodo, UpdateTodo and DeleteTodo return
+// ErrTodoNotFound if there is no todo with the ID.
+//
+// Writes are optimistic: UpdateTodo only replaces the todo if the stored
+// version is still todo.Version, and then increments todo.Version;
+// DeleteTodo only deletes the given version, or any version if it is 0.
+// Otherwise they return ErrVersionConflict.
+type TodoStore interface {
+	ListTodos(ctx context.Context, filter TodoFilter) ([]*Todo, error)
+	GetTodo(ctx context.Context, id string) (*Todo, error)
+	CreateTodo(ctx context.Context, todo *Todo) error
+	UpdateTodo(ctx context.Context, id string, todo *Todo) error
+	DeleteTodo(ctx context.Context, id string, version int64) error
+	DeleteTodosByOwner(ctx context.Context, ownerID string) error
+	// CountSubtasks returns how many subtasks each of the todos with the
+	// given IDs has and how many of them are done. Todos without subtasks
+	// are left out.
+	CountSubtasks(ctx context.Context, parentIDs []string) (map[string]*Progress, error)
+	// RemoveBlocker takes id off the blockers of every todo, incrementing
+	// their versions.
+	RemoveBlocker(ctx context.Context, id string) error
+	// SetTodoPositions sets the position of each todo in positions, keyed by
+	// ID, and increments its version whatever version it is at. Todos that
+	// don't exist are skipped.
+	SetTodoPositions(ctx context.Context, positions map[string]string) error
+	// TouchTodos increments the versions of the todos with the given IDs
+	// whatever versions they are at, for changes to what they show that
+	// aren't stored on them, like the progress of their subtasks.
+	TouchTodos(ctx context.Context, ids []string) error
+}
+
+// TagStore persists tags. Tag names are unique per owner, and todos refer
+// to tags by name, so the methods that rename or remove a tag rewrite the
+// owner's todos in the same transaction, incrementing their versions.
+// GetTag, UpdateTag, MergeTag and DeleteTag return ErrTagNotFound if a tag
+// doesn't exist, and check versions the same way as the TodoStore methods.
+type TagStore interface {
+	// ListTags returns ownerID's tags ordered by name.
+	ListTags(ctx context.Context, ownerID string) ([]*Tag, error)
+	GetTag(ctx context.Context, id string) (*Tag, error)
+	// CreateTag returns ErrDuplicate if the owner already has a tag with
+	// the name.
+	CreateTag(ctx context.Context, tag *Tag) error
+	// UpdateTag replaces the tag, renaming it on the owner's todos if the
+	// name changed. It returns ErrDuplicate if the new name is taken.
+	UpdateTag(ctx context.Context, id string, tag *Tag) error
+	// MergeTag deletes from and gives its todos into instead.
+	MergeTag(ctx context.Context, from, into *Tag) error
+	// DeleteTag deletes the tag and takes it off the owner's todos.
+	DeleteTag(ctx context.Context, id string, version int64) error
+	DeleteTagsByOwner(ctx context.Context, ownerID string) error
+	// EnsureTags creates the tags ownerID doesn't have yet.
+	EnsureTags(ctx context.Context, ownerID string, names []string) error
+	// CountTags returns how many of ownerID's todos have each tag.
+	CountTags(ctx context.Context, ownerID string) (map[string]int, error)
+}
+
+// CommentStore persists the comments on todos. GetComment, UpdateComment
+// and DeleteComment return ErrCommentNotFound if there is no comment with
+// the ID, and check versions the same way as the TodoStore methods.
+type CommentStore interface {
+	// ListComments returns the comments on a todo, oldest first.
+	ListComments(ctx context.Context, todoID string) ([]*Comment, error)
+	GetComment(ctx context.Context, id string) (*Comment, error)
+	CreateComment(ctx context.Context, comment *Comment) error
+	UpdateComment(ctx context.Context, id string, comment *Comment) error
+	DeleteComment(ctx context.Context, id string, version int64) error
+	// DeleteCommentsByTodos deletes the comments on the todos with the
+	// given IDs.
+	DeleteCommentsByTodos(ctx context.Context, todoIDs []string) error
+}
+
+// UserFilter narrows the users returned by ListUsers, which are ordered by
+// username and then ID. Zero fields match everything.
+type UserFilter struct {
+	// Prefix matches users whose name or username starts with it, ignoring
+	// case.
+	Prefix string
+	Scope  string
+	// After resumes a listing after the user the cursor points at.
+	After *UserCursor
+	// Limit caps the number of users returned; 0 means no limit.
+	Limit int
+}
+
+// UserCursor is the sort key of the last user on a page.
+type UserCursor struct {
+	Username string `json:"u"`
+	ID       string `json:"id"`
+}
+
+// UserStore persists users. Getting, updating or deleting a user that
+// doesn't exist returns ErrUserNotFound. UpdateUser and DeleteUser check
+// versions the same way as the TodoStore methods.
+type UserStore interface {
+	ListUsers(ctx context.Context, filter UserFilter) ([]*User, error)
+	GetUser(ctx context.Context, id string) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	CreateUser(ctx context.Context, user *User) error
+	UpdateUser(ctx context.Context, id string, user *User) error
+	DeleteUser(ctx context.Context, id string, version int64) error
+}
+
+// TokenStore persists refresh tokens and access token revocations.
+type TokenStore interface {
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	GetRefreshToken(ctx context.Context, id string) (*RefreshToken, error)
+	// UseRefreshToken marks an unused token as used at the given time. It
+	// returns false if the token had already been used.
+	UseRefreshToken(ctx context.Context, id string, at time.Time) (bool, error)
+	RevokeTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID string) error
+
+	// Revoke records rev, replacing any revocation with the same ID.
+	// Revocations are pruned once they expire.
+	Revoke(ctx context.Context, rev *Revocation) error
+	// IsRevoked reports whether the token described by claims was revoked.
+	IsRevoked(ctx context.Context, claims *TodoClaims) (bool, error)
+}
+
+var todoStore TodoStore
+var userStore UserStore
+var tokenStore TokenStore
+var tagStore TagStore
+var commentStore CommentStore
+
+// openStores sets up the stores for the driver configured in
+// storage.driver ("mongo" or "memory"). The returned function releases any
+// resources held by the stores.
+func openStores(ctx context.Context) (func(context.Context) error, error) {
+	driver := viper.GetString("storage.driver")
+	switch driver {
+	case "", "mongo":
+		var err error
+		client, err = getMongoClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = checkTransactions(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		todos := newMongoTodoStore(client)
+		err = todos.migrate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = setMissingVersions(ctx, todos.coll)
+		if err != nil {
+			return nil, err
+		}
+		err = todos.createIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		todoStore = todos
+		tags := newMongoTagStore(client)
+		err = tags.createIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tagStore = tags
+		comments := newMongoCommentStore(client)
+		err = comments.createIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		commentStore = comments
+		users := newMongoUserStore(client)
+		err = setMissingVersions(ctx, users.coll)
+		if err != nil {
+			return nil, err
+		}
+		err = users.createIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		userStore = users
+		tokens := newMongoTokenStore(client)
+		err = tokens.createIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tokenStore = tokens
+		return client.Disconnect, nil
+	case "memory":
+		todos := newMemoryTodoStore()
+		todoStore = todos
+		tagStore = newMemoryTagStore(todos)
+		commentStore = newMemoryCommentStore()
+		userStore = newMemoryUserStore()
+		tokenStore = newMemoryTokenStore()
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", driver)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Progress counts the subtasks of a todo and how many of them are done.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// maxSubtaskDepth bounds how deeply subtasks nest.
+const maxSubtaskDepth = 16
+
+// fillProgress sets Progress on those of todos that have subtasks.
+func fillProgress(r *http.Request, todos ...*Todo) error {
+	if len(todos) == 0 {
+		return nil
+	}
+	ids := make([]string, len(todos))
+	for i, todo := range todos {
+		ids[i] = todo.ID
+	}
+	progress, err := todoStore.CountSubtasks(r.Context(), ids)
+	if err != nil {
+		return err
+	}
+	for _, todo := range todos {
+		todo.Progress = progress[todo.ID]
+	}
+	return nil
+}
+
+// checkParent writes a 422 response and returns false if todo can't be a
+// subtask of its parent. The parent must exist and belong to the same
+// owner, and must not be todo itself or one of its subtasks, which would
+// make a cycle.
+func checkParent(w http.ResponseWriter, r *http.Request, todo *Todo) bool {
+	invalid := func(code, message string) bool {
+		writeError(w, r, validationFailed(FieldError{Field: "parentId", Code: code, Message: message}))
+		return false
+	}
+	id := todo.ParentID
+	for depth := 0; id != ""; depth++ {
+		if id == todo.ID {
+			return invalid("cycle", "a todo cannot be a subtask of itself or of its own subtasks")
+		}
+		if depth == maxSubtaskDepth {
+			return invalid("too_deep", fmt.Sprintf("subtasks can only be nested %d deep", maxSubtaskDepth))
+		}
+		parent, err := todoStore.GetTodo(r.Context(), id)
+		if errors.Is(err, ErrTodoNotFound) && depth > 0 {
+			// An ancestor deleted since; the chain ends here.
+			break
+		}
+		if errors.Is(err, ErrTodoNotFound) || (err == nil && depth == 0 && parent.OwnerID != todo.OwnerID) {
+			return invalid("parent_not_found", "todo "+id+" does not exist or belongs to another owner")
+		}
+		if err != nil {
+			writeError(w, r, internalError("could not find parent", err))
+			return false
+		}
+		id = parent.ParentID
+	}
+	return true
+}
+
+// subtasksOf returns the subtasks of todo, their subtasks and so on, each
+// level before the next. Todos already seen are skipped and the search stops
+// at maxSubtaskDepth, so a cycle left by concurrent writes can't loop.
+func subtasksOf(ctx context.Context, todo *Todo) ([]*Todo, error) {
+	subtasks := []*Todo{}
+	seen := map[string]bool{todo.ID: true}
+	level := []*Todo{todo}
+	for depth := 0; depth < maxSubtaskDepth && len(level) > 0; depth++ {
+		next := []*Todo{}
+		for _, parent := range level {
+			children, err := todoStore.ListTodos(ctx, TodoFilter{ParentID: parent.ID, Sort: TodoSort{Field: sortPosition}})
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				if !seen[child.ID] {
+					seen[child.ID] = true
+					next = append(next, child)
+				}
+			}
+		}
+		subtasks = append(subtasks, next...)
+		level = next
+	}
+	return subtasks, nil
+}
+
+// openSubtasks runs before todo is stored as done. Open subtasks keep their
+// parent from being completed unless the request has ?cascade=true, in which
+// case they are returned for completeSubtasks. Each of them must be able to
+// complete as a transition would: the workflow must allow it and, unless the
+// request has ?force=true, it must not be blocked by todos other than those
+// completed along with it. It writes the error response and returns false if
+// todo can't be completed.
+func openSubtasks(w http.ResponseWriter, r *http.Request, todo *Todo) ([]*Todo, bool) {
+	subtasks, err := subtasksOf(r.Context(), todo)
+	if err != nil {
+		writeError(w, r, internalError("could not find subtasks", err))
+		return nil, false
+	}
+	open := []*Todo{}
+	completing := []string{todo.ID}
+	for _, subtask := range subtasks {
+		if subtask.CompletedAt == nil {
+			open = append(open, subtask)
+			completing = append(completing, subtask.ID)
+		}
+	}
+	if len(open) > 0 && r.URL.Query().Get("cascade") != "true" {
+		writeError(w, r, newError(http.StatusConflict, codeOpenSubtasks, fmt.Sprintf("todo has %d open subtasks, complete with ?cascade=true to complete them too", len(open))))
+		return nil, false
+	}
+	errs := []FieldError{}
+	for _, subtask := range open {
+		if !workflow.CanTransition(subtask.Status, StatusDone) {
+			errs = append(errs, FieldError{Field: "subtasks", Code: "invalid_transition", Message: fmt.Sprintf("cannot move subtask %s from %s to %s", subtask.ID, subtask.Status, StatusDone)})
+			continue
+		}
+		if r.URL.Query().Get("force") == "true" {
+			continue
+		}
+		blockers, err := openBlockers(r.Context(), subtask)
+		if err != nil {
+			writeError(w, r, internalError("could not find blocker", err))
+			return nil, false
+		}
+		for _, blocker := range blockers {
+			if !containsString(completing, blocker) {
+				errs = append(errs, FieldError{Field: "subtasks", Code: "blocked", Message: "subtask " + subtask.ID + " is blocked by open todos " + strings.Join(blockers, ", ")})
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		writeError(w, r, validationFailed(errs...))
+		return nil, false
+	}
+	return open, true
+}
+
+// completeSubtasks runs once todo is stored as done and completes the open
+// subtasks openSubtasks found, scheduling the next occurrence of those that
+// recur. Storing the parent first means a parent that fails its version
+// check leaves its subtasks alone. The parents of the completed subtasks are
+// touched, todo included, whose Version is kept current. It writes the error
+// response and returns false if that fails.
+func completeSubtasks(w http.ResponseWriter, r *http.Request, todo *Todo, open []*Todo, at time.Time) bool {
+	parents := []string{}
+	for _, subtask := range open {
+		setStatus(subtask, StatusDone, at)
+		subtask.UpdatedAt = at
+		err := todoStore.UpdateTodo(r.Context(), subtask.ID, subtask)
+		if err != nil {
+			writeError(w, r, storeError("could not complete subtask "+subtask.ID, err))
+			return false
+		}
+		if _, ok := scheduleNext(w, r, subtask); !ok {
+			return false
+		}
+		if !containsString(parents, subtask.ParentID) {
+			parents = append(parents, subtask.ParentID)
+		}
+	}
+	if len(parents) == 0 {
+		return true
+	}
+	err := todoStore.TouchTodos(r.Context(), parents)
+	if err != nil {
+		writeError(w, r, internalError("could not touch parents", err))
+		return false
+	}
+	if containsString(parents, todo.ID) {
+		todo.Version++
+	}
+	return true
+}
+
+// touchParents touches the parents whose progress a write of a todo changed,
+// so that their ETags change along with it. before is nil for new todos and
+// after is nil for deleted ones. Failures are only logged, since the write
+// itself went through.
+func touchParents(ctx context.Context, before, after *Todo) {
+	ids := []string{}
+	if before != nil && before.ParentID != "" &&
+		(after == nil || after.ParentID != before.ParentID || (after.CompletedAt == nil) != (before.CompletedAt == nil)) {
+		ids = append(ids, before.ParentID)
+	}
+	if after != nil && after.ParentID != "" && (before == nil || before.ParentID != after.ParentID) {
+		ids = append(ids, after.ParentID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	err := todoStore.TouchTodos(ctx, ids)
+	if err != nil {
+		log.Printf("could not touch parents %v: %s\n", ids, err)
+	}
+}
+
+// deleteSubtasks runs before todo is deleted. A todo with subtasks is only
+// deleted along with them, and only when asked with ?cascade=true. It returns
+// the subtasks to delete once todo is gone, or writes the error response and
+// returns false.
+func deleteSubtasks(w http.ResponseWriter, r *http.Request, todo *Todo) ([]*Todo, bool) {
+	subtasks, err := subtasksOf(r.Context(), todo)
+	if err != nil {
+		writeError(w, r, internalError("could not find subtasks", err))
+		return nil, false
+	}
+	if len(subtasks) > 0 && r.URL.Query().Get("cascade") != "true" {
+		writeError(w, r, newError(http.StatusConflict, codeTodoHasSubtasks, "todo has subtasks, delete with ?cascade=true to remove them too"))
+		return nil, false
+	}
+	return subtasks, true
+}
+
+// getSubtasks lists the direct subtasks of a todo in position order.
+func getSubtasks(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting subtasks...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil {
+		return
+	}
+	subtasks, err := todoStore.ListTodos(r.Context(), TodoFilter{ParentID: todo.ID, Sort: TodoSort{Field: sortPosition}})
+	if err != nil {
+		writeError(w, r, internalError("could not find subtasks", err))
+		return
+	}
+	err = fillProgress(r, subtasks...)
+	if err != nil {
+		writeError(w, r, internalError("could not count subtasks", err))
+		return
+	}
+	expandOwners(r, subtasks...)
+	writeJSON(w, r, http.StatusOK, subtasks)
+}
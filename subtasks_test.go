@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// racingTodoStore writes the todo raceID once more right before a caller
+// updates it, as a concurrent request would.
+type racingTodoStore struct {
+	TodoStore
+	raceID string
+}
+
+func (s *racingTodoStore) UpdateTodo(ctx context.Context, id string, todo *Todo) error {
+	if id == s.raceID {
+		stored, _ := s.TodoStore.GetTodo(ctx, id)
+		s.TodoStore.UpdateTodo(ctx, id, stored)
+	}
+	return s.TodoStore.UpdateTodo(ctx, id, todo)
+}
+
+func TestSubtasks(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	createTestUser(t, &User{ID: "bob", Username: "bob"})
+	parent := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Move house"}`))
+	pack := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Pack","parentId":"`+parent+`"}`))
+	van := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Rent van","parentId":"`+parent+`"}`))
+	books := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Pack books","parentId":"`+pack+`"}`))
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+van+"/transitions", `{"to":"done"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := send(t, testAdmin, "GET", "/api/v1/todos/"+parent, "")
+	todo := &Todo{}
+	json.NewDecoder(w.Body).Decode(todo)
+	if todo.Progress == nil || todo.Progress.Done != 1 || todo.Progress.Total != 2 {
+		t.Errorf("Expected 1/2 subtasks done, got %+v", todo.Progress)
+	}
+
+	// Changes to the progress change the parent's ETag
+	tag := w.Header().Get("ETag")
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+van+"/transitions", `{"to":"new"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "GET", "/api/v1/todos/"+parent, "", "If-None-Match", tag); w.Code != 200 {
+		t.Errorf("Expected status code 200 after a subtask was reopened, got %d", w.Code)
+	}
+	send(t, testAdmin, "POST", "/api/v1/todos/"+van+"/transitions", `{"to":"done"}`)
+
+	w = send(t, testAdmin, "GET", "/api/v1/todos/"+parent+"/subtasks", "")
+	subtasks := []*Todo{}
+	json.NewDecoder(w.Body).Decode(&subtasks)
+	if len(subtasks) != 2 || subtasks[0].ID != pack || subtasks[1].ID != van || subtasks[0].Progress.Total != 1 {
+		t.Errorf("Expected the direct subtasks in order with their progress, got %+v", subtasks)
+	}
+
+	// Parents must exist, belong to the same owner and not make a cycle
+	todoStore.CreateTodo(ctx, &Todo{ID: "bobs", Title: "Bob's", OwnerID: "bob"})
+	invalid := []struct{ target, body, code string }{
+		{"/api/v1/todos/" + parent, `{"parentId":"` + books + `"}`, "cycle"},
+		{"/api/v1/todos/" + pack, `{"parentId":"` + pack + `"}`, "cycle"},
+		{"/api/v1/todos/" + pack, `{"parentId":"missing"}`, "parent_not_found"},
+		{"/api/v1/todos/" + pack, `{"parentId":"bobs"}`, "parent_not_found"},
+		{"/api/v1/todos/" + parent, `{"ownerId":"bob"}`, "has_subtasks"},
+	}
+	for _, tt := range invalid {
+		w := send(t, testAdmin, "PATCH", tt.target, tt.body)
+		if w.Code != 422 {
+			t.Errorf("%s %s: expected status code 422, got %d: %s", tt.target, tt.body, w.Code, w.Body.String())
+			continue
+		}
+		if problem := decodeProblem(t, w); len(problem.Errors) != 1 || problem.Errors[0].Code != tt.code {
+			t.Errorf("%s %s: expected %s, got %+v", tt.target, tt.body, tt.code, problem.Errors)
+		}
+	}
+
+	// Completing a parent with open subtasks needs ?cascade=true
+	if w := send(t, testAdmin, "PATCH", "/api/v1/todos/"+parent, `{"status":"started"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send(t, testAdmin, "POST", "/api/v1/todos/"+parent+"/transitions", `{"to":"done"}`)
+	if w.Code != 409 || decodeProblem(t, w).Code != codeOpenSubtasks {
+		t.Fatalf("Expected status code 409, got %d: %s", w.Code, w.Body.String())
+	}
+	todoStore = &racingTodoStore{TodoStore: todoStore, raceID: parent}
+	w = send(t, testAdmin, "POST", "/api/v1/todos/"+parent+"/transitions?cascade=true", `{"to":"done"}`)
+	todoStore = todoStore.(*racingTodoStore).TodoStore
+	if w.Code != 412 {
+		t.Fatalf("Expected status code 412, got %d: %s", w.Code, w.Body.String())
+	}
+	if todo, _ := todoStore.GetTodo(ctx, pack); todo.CompletedAt != nil {
+		t.Errorf("Expected a parent that lost a race to leave its subtasks open")
+	}
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+parent+"/transitions?cascade=true", `{"to":"done"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, id := range []string{parent, pack, books} {
+		todo, _ := todoStore.GetTodo(ctx, id)
+		if todo.Status != StatusDone || todo.CompletedAt == nil {
+			t.Errorf("Expected %s to be done, got %+v", todo.Title, todo)
+		}
+	}
+
+	// Deleting a parent needs ?cascade=true and takes every subtask along
+	if w := send(t, testAdmin, "DELETE", "/api/v1/todos/"+parent, ""); w.Code != 409 {
+		t.Errorf("Expected status code 409, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(t, testAdmin, "DELETE", "/api/v1/todos/"+parent+"?cascade=true", ""); w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, id := range []string{parent, pack, van, books} {
+		if _, err := todoStore.GetTodo(ctx, id); err == nil {
+			t.Errorf("Expected todo %s to be deleted", id)
+		}
+	}
+}
+
+func TestCascadedSubtasks(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	parent := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Release"}`))
+	review := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Review"}`))
+	notes := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Write notes","parentId":"`+parent+`","blockedBy":["`+review+`"]}`))
+	tag := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Tag","parentId":"`+parent+`","blockedBy":["`+notes+`"]}`))
+	standup := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Standup","parentId":"`+parent+`",`+
+		`"dueAt":"2026-03-26T09:00:00Z","recurrence":{"rule":"FREQ=DAILY;COUNT=2"}}`))
+
+	// Subtasks blocked by todos outside the cascade refuse it
+	w := send(t, testAdmin, "POST", "/api/v1/todos/"+parent+"/transitions?cascade=true", `{"to":"done"}`)
+	if w.Code != 422 {
+		t.Fatalf("Expected status code 422, got %d: %s", w.Code, w.Body.String())
+	}
+	if problem := decodeProblem(t, w); len(problem.Errors) != 1 || problem.Errors[0].Code != "blocked" || !strings.Contains(problem.Errors[0].Message, notes) {
+		t.Errorf("Expected only %s to be blocked, got %+v", notes, problem.Errors)
+	}
+	if todo, _ := todoStore.GetTodo(ctx, parent); todo.CompletedAt != nil {
+		t.Errorf("Expected a refused cascade to leave the parent open")
+	}
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+review+"/transitions", `{"to":"done"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// So do subtasks the workflow can't move to done
+	if w := send(t, testAdmin, "PATCH", "/api/v1/todos/"+tag, `{"status":"started"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	saved := workflow
+	workflow = &Workflow{Initial: StatusNew, Transitions: map[TodoStatus][]TodoStatus{
+		StatusNew:     {StatusStarted, StatusDone},
+		StatusStarted: {StatusNew},
+		StatusDone:    {StatusNew},
+	}}
+	w = send(t, testAdmin, "POST", "/api/v1/todos/"+parent+"/transitions?cascade=true", `{"to":"done"}`)
+	workflow = saved
+	if w.Code != 422 {
+		t.Fatalf("Expected status code 422, got %d: %s", w.Code, w.Body.String())
+	}
+	if problem := decodeProblem(t, w); len(problem.Errors) != 1 || problem.Errors[0].Code != "invalid_transition" || !strings.Contains(problem.Errors[0].Message, tag) {
+		t.Errorf("Expected only %s to be refused, got %+v", tag, problem.Errors)
+	}
+
+	// Blockers completed along with them don't count, and recurring subtasks
+	// get their next occurrence
+	if w := send(t, testAdmin, "POST", "/api/v1/todos/"+parent+"/transitions?cascade=true", `{"to":"done"}`); w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	todos, _ := todoStore.ListTodos(ctx, TodoFilter{})
+	next := 0
+	for _, todo := range todos {
+		if todo.Recurrence != nil && todo.Recurrence.SeriesID == standup && todo.ID != standup {
+			next++
+		}
+	}
+	if next != 1 {
+		t.Errorf("Expected the recurring subtask to schedule its next occurrence, got %d", next)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tag labels todos of its owner, which refer to it by name. Names are
+// lowercase and unique per owner; Color is an optional "#rrggbb" color.
+// Count is the number of todos with the tag, filled in on responses only.
+type Tag struct {
+	ID        string    `json:"id" bson:"_id"`
+	OwnerID   string    `json:"ownerId" bson:"ownerId"`
+	Name      string    `json:"name" bson:"name" validate:"required,tag"`
+	Color     string    `json:"color,omitempty" bson:"color,omitempty" validate:"color"`
+	Count     int       `json:"count" bson:"-"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	Version   int64     `json:"version" bson:"version"`
+}
+
+// normalizeTag makes tag names case-insensitive.
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// normalizeTags normalizes the tags of todo and drops duplicates.
+func normalizeTags(todo *Todo) {
+	tags := []string{}
+	for _, tag := range todo.Tags {
+		tag = normalizeTag(tag)
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	todo.Tags = tags
+}
+
+// ensureTags creates the tags of todo its owner doesn't have yet. It writes
+// the error response and returns false if that fails.
+func ensureTags(w http.ResponseWriter, r *http.Request, todo *Todo) bool {
+	err := tagStore.EnsureTags(r.Context(), todo.OwnerID, todo.Tags)
+	if err != nil {
+		writeError(w, r, internalError("could not create tags", err))
+		return false
+	}
+	return true
+}
+
+func tagExists(name string) *APIError {
+	return &APIError{
+		Status: http.StatusConflict,
+		Code:   codeTagExists,
+		Detail: "tag " + name + " already exists, merge into it instead",
+		Fields: []FieldError{{Field: "name", Code: "taken", Message: "is taken"}},
+	}
+}
+
+// countTags fills in Count on tags, which all belong to ownerID.
+func countTags(r *http.Request, ownerID string, tags ...*Tag) error {
+	counts, err := tagStore.CountTags(r.Context(), ownerID)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tag.Count = counts[tag.Name]
+	}
+	return nil
+}
+
+// tagETag is the entity tag of a tag. Its Count is part of the response but
+// changes without the tag being written, so it is part of the tag too.
+func tagETag(tag *Tag) string {
+	return `"` + strconv.FormatInt(tag.Version, 10) + "." + strconv.Itoa(tag.Count) + `"`
+}
+
+// getAccessibleTag loads the tag named in the URL with its count and checks
+// the caller may access it, the same way as for todos. It writes the error
+// response and returns nil if not.
+func getAccessibleTag(w http.ResponseWriter, r *http.Request) *Tag {
+	tagID := mux.Vars(r)["tagID"]
+	if tagID == "" {
+		writeError(w, r, badRequest("tagID is required", nil))
+		return nil
+	}
+	tag, err := tagStore.GetTag(r.Context(), tagID)
+	if err != nil {
+		writeError(w, r, storeError("could not find tag", err))
+		return nil
+	}
+	claims := claimsFromContext(r.Context())
+	if !claims.HasScope(scopeTodosAdmin) && tag.OwnerID != claims.ID {
+		log.Printf("user %s cannot access tag %s\n", claims.ID, tagID)
+		writeError(w, r, forbidden("cannot access tag "+tagID))
+		return nil
+	}
+	err = countTags(r, tag.OwnerID, tag)
+	if err != nil {
+		writeError(w, r, internalError("could not count tags", err))
+		return nil
+	}
+	return tag
+}
+
+// getTags lists the caller's tags with their usage counts. Admins may ask for
+// another owner's tags with ?owner=<userID>.
+func getTags(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting tags...")
+	claims := claimsFromContext(r.Context())
+	ownerID := claims.ID
+	if r.URL.Query().Has("owner") {
+		if !claims.HasScope(scopeTodosAdmin) {
+			writeError(w, r, newError(http.StatusForbidden, codeMissingScope, "missing scope "+scopeTodosAdmin))
+			return
+		}
+		ownerID = r.URL.Query().Get("owner")
+	}
+	tags, err := tagStore.ListTags(r.Context(), ownerID)
+	if err != nil {
+		writeError(w, r, internalError("could not find tags", err))
+		return
+	}
+	err = countTags(r, ownerID, tags...)
+	if err != nil {
+		writeError(w, r, internalError("could not count tags", err))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, tags)
+}
+
+func getTag(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting tag...")
+	tag := getAccessibleTag(w, r)
+	if tag == nil || notModifiedETag(w, r, tagETag(tag)) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, tag)
+}
+
+func createTag(w http.ResponseWriter, r *http.Request) {
+	log.Println("Creating tag...")
+	tag := &Tag{}
+	err := json.NewDecoder(r.Body).Decode(tag)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode tag", err))
+		return
+	}
+	tag.Name = normalizeTag(tag.Name)
+	if !checkValid(w, r, tag) {
+		return
+	}
+	tag.ID, err = newID()
+	if err != nil {
+		writeError(w, r, internalError("could not generate id", err))
+		return
+	}
+	tag.OwnerID = claimsFromContext(r.Context()).ID
+	tag.Count = 0
+	tag.CreatedAt = currentTime()
+	tag.Version = 1
+	err = tagStore.CreateTag(r.Context(), tag)
+	if errors.Is(err, ErrDuplicate) {
+		writeError(w, r, tagExists(tag.Name))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("could not create tag", err))
+		return
+	}
+	w.Header().Set("Location", "/api/v1/tags/"+tag.ID)
+	w.Header().Set("ETag", tagETag(tag))
+	writeJSON(w, r, http.StatusCreated, tag)
+}
+
+// updateTag changes a tag's color or renames it. Renaming rewrites the
+// owner's todos along with the tag; renaming to a name that is taken fails,
+// and the tags have to be merged instead.
+func updateTag(w http.ResponseWriter, r *http.Request) {
+	log.Println("Updating tag...")
+	existing := getAccessibleTag(w, r)
+	if existing == nil || !checkIfMatchETag(w, r, tagETag(existing)) {
+		return
+	}
+	tag := &Tag{}
+	err := json.NewDecoder(r.Body).Decode(tag)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode tag", err))
+		return
+	}
+	tag.Name = normalizeTag(tag.Name)
+	if !checkValid(w, r, tag) {
+		return
+	}
+	tag.ID = existing.ID
+	tag.OwnerID = existing.OwnerID
+	tag.CreatedAt = existing.CreatedAt
+	tag.Version = existing.Version
+	err = tagStore.UpdateTag(r.Context(), tag.ID, tag)
+	if errors.Is(err, ErrDuplicate) {
+		writeError(w, r, tagExists(tag.Name))
+		return
+	}
+	if err != nil {
+		writeError(w, r, storeError("could not update tag", err))
+		return
+	}
+	err = countTags(r, tag.OwnerID, tag)
+	if err != nil {
+		writeError(w, r, internalError("could not count tags", err))
+		return
+	}
+	w.Header().Set("ETag", tagETag(tag))
+	writeJSON(w, r, http.StatusOK, tag)
+}
+
+// deleteTag deletes a tag and takes it off the owner's todos.
+func deleteTag(w http.ResponseWriter, r *http.Request) {
+	log.Println("Deleting tag...")
+	tag := getAccessibleTag(w, r)
+	if tag == nil || !checkIfMatchETag(w, r, tagETag(tag)) {
+		return
+	}
+	err := tagStore.DeleteTag(r.Context(), tag.ID, tag.Version)
+	if err != nil {
+		writeError(w, r, storeError("could not delete tag", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MergeRequest names the tag to merge into.
+type MergeRequest struct {
+	Into string `json:"into"`
+}
+
+// mergeTag merges the tag in the URL into another tag of the same owner:
+// its todos get the other tag instead and it is deleted. The response is
+// the tag merged into.
+func mergeTag(w http.ResponseWriter, r *http.Request) {
+	log.Println("Merging tag...")
+	from := getAccessibleTag(w, r)
+	if from == nil || !checkIfMatchETag(w, r, tagETag(from)) {
+		return
+	}
+	mr := &MergeRequest{}
+	err := json.NewDecoder(r.Body).Decode(mr)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode merge", err))
+		return
+	}
+	if mr.Into == "" || mr.Into == from.ID {
+		writeError(w, r, validationFailed(FieldError{Field: "into", Code: "invalid_target", Message: "must name another tag"}))
+		return
+	}
+	into, err := tagStore.GetTag(r.Context(), mr.Into)
+	if errors.Is(err, ErrTagNotFound) || (err == nil && into.OwnerID != from.OwnerID) {
+		writeError(w, r, validationFailed(FieldError{Field: "into", Code: "invalid_target", Message: "tag " + mr.Into + " does not belong to the same owner"}))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("could not find tag "+mr.Into, err))
+		return
+	}
+
+	err = tagStore.MergeTag(r.Context(), from, into)
+	if err != nil {
+		writeError(w, r, storeError("could not merge tag", err))
+		return
+	}
+	err = countTags(r, into.OwnerID, into)
+	if err != nil {
+		writeError(w, r, internalError("could not count tags", err))
+		return
+	}
+	w.Header().Set("ETag", tagETag(into))
+	writeJSON(w, r, http.StatusOK, into)
+}
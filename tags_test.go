@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// tagsByName lists the caller's tags keyed by name.
+func tagsByName(t *testing.T) map[string]*Tag {
+	t.Helper()
+	w := send(t, testAdmin, "GET", "/api/v1/tags", "")
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	tags := []*Tag{}
+	json.NewDecoder(w.Body).Decode(&tags)
+	byName := map[string]*Tag{}
+	for _, tag := range tags {
+		byName[tag.Name] = tag
+	}
+	return byName
+}
+
+func todoTags(t *testing.T, id string) string {
+	t.Helper()
+	todo, err := todoStore.GetTodo(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Error getting todo: %s\n", err)
+	}
+	return strings.Join(todo.Tags, ",")
+}
+
+func TestTodoTags(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+	ids := map[string]string{}
+	for title, tags := range map[string]string{
+		"a": `["Home", "errands", "home"]`,
+		"b": `["work"]`,
+		"c": `["work", "urgent"]`,
+		"d": `[]`,
+	} {
+		ids[title] = createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"`+title+`","tags":`+tags+`}`))
+	}
+	if got := todoTags(t, ids["a"]); got != "home,errands" {
+		t.Errorf("Expected tags to be normalized, got %s", got)
+	}
+
+	tags := tagsByName(t)
+	if len(tags) != 4 || tags["work"].Count != 2 || tags["home"].Count != 1 {
+		t.Errorf("Expected used tags to be created with counts, got %+v", tags)
+	}
+
+	// The count is part of a tag's ETag
+	target := "/api/v1/tags/" + tags["urgent"].ID
+	tag := send(t, testAdmin, "GET", target, "").Header().Get("ETag")
+	extra := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"e","tags":["urgent"]}`))
+	w := send(t, testAdmin, "GET", target, "", "If-None-Match", tag)
+	if w.Code != 200 || w.Header().Get("ETag") == tag {
+		t.Errorf("Expected a new count to change the ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if w := send(t, testAdmin, "PUT", target, `{"name":"urgent","color":"#ff0000"}`, "If-Match", tag); w.Code != 412 {
+		t.Errorf("Expected status code 412 for the old ETag, got %d", w.Code)
+	}
+	send(t, testAdmin, "DELETE", "/api/v1/todos/"+extra, "")
+
+	filters := []struct {
+		query, want string
+	}{
+		{"tagsAny=home,urgent", "ac"},
+		{"tagsAll=work,urgent", "c"},
+		{"tagsNone=work", "ad"},
+		{"tagsAny=work&tagsNone=URGENT", "b"},
+	}
+	for _, f := range filters {
+		todos, _ := listTodos(t, testAdmin, "/api/v1/todos?sort=title&"+f.query)
+		got := ""
+		for _, todo := range todos {
+			got += todo.Title
+		}
+		if got != f.want {
+			t.Errorf("%s: expected %s, got %s", f.query, f.want, got)
+		}
+	}
+
+	for _, body := range []string{`{"title":"x","tags":["a,b"]}`, `{"title":"x","tags":["-x"]}`} {
+		if w := send(t, testAdmin, "POST", "/api/v1/todos", body); w.Code != 422 {
+			t.Errorf("%s: expected status code 422, got %d", body, w.Code)
+		}
+	}
+
+	// Refused todos don't create their tags
+	send(t, testAdmin, "PUT", "/api/v1/todos/"+ids["d"], `{"title":"d","status":"done"}`)
+	refused := []struct{ method, target, body string }{
+		{"POST", "/api/v1/todos", `{"title":"x","status":"done","tags":["ghost"]}`},
+		{"PUT", "/api/v1/todos/" + ids["d"], `{"title":"d","status":"started","tags":["ghost"]}`},
+	}
+	for _, tt := range refused {
+		if w := send(t, testAdmin, tt.method, tt.target, tt.body); w.Code != 422 {
+			t.Errorf("%s %s: expected status code 422, got %d", tt.method, tt.target, w.Code)
+		}
+	}
+	if _, ok := tagsByName(t)["ghost"]; ok {
+		t.Errorf("Expected no tag for refused todos")
+	}
+}
+
+func TestRenameMergeAndDeleteTags(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	a := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"a","tags":["job","work"]}`))
+	b := createdID(t, send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"b","tags":["job","home"]}`))
+	tags := tagsByName(t)
+
+	// Renaming rewrites the todos and changes their versions
+	before, _ := todoStore.GetTodo(ctx, b)
+	w := send(t, testAdmin, "PUT", "/api/v1/tags/"+tags["home"].ID, `{"name":"House","color":"#00aa00"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	after, _ := todoStore.GetTodo(ctx, b)
+	if got := todoTags(t, b); got != "job,house" || after.Version == before.Version {
+		t.Errorf("Expected the todo to be retagged with a new version, got %s at version %d", got, after.Version)
+	}
+	if w := send(t, testAdmin, "PUT", "/api/v1/tags/"+tags["job"].ID, `{"name":"work"}`); w.Code != 409 || decodeProblem(t, w).Code != codeTagExists {
+		t.Errorf("Expected renaming onto a taken name to get 409, got %d", w.Code)
+	}
+
+	// Merging moves the todos over without duplicating tags
+	w = send(t, testAdmin, "POST", "/api/v1/tags/"+tags["job"].ID+"/merge", `{"into":"`+tags["work"].ID+`"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	merged := &Tag{}
+	json.NewDecoder(w.Body).Decode(merged)
+	if merged.Name != "work" || merged.Count != 2 {
+		t.Errorf("Expected the merged tag to have both todos, got %+v", merged)
+	}
+	if todoTags(t, a) != "work" || todoTags(t, b) != "work,house" {
+		t.Errorf("Expected job to become work, got %s and %s", todoTags(t, a), todoTags(t, b))
+	}
+	if _, ok := tagsByName(t)["job"]; ok {
+		t.Errorf("Expected the merged tag to be gone")
+	}
+
+	// Deleting takes the tag off its todos
+	if w := send(t, testAdmin, "DELETE", "/api/v1/tags/"+tags["work"].ID, ""); w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if todoTags(t, a) != "" || todoTags(t, b) != "house" {
+		t.Errorf("Expected work to be removed, got %q and %q", todoTags(t, a), todoTags(t, b))
+	}
+
+	tests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{"POST", "/api/v1/tags", `{"name":"house"}`, 409},
+		{"POST", "/api/v1/tags", `{"name":"garden","color":"green"}`, 422},
+		{"POST", "/api/v1/tags", `{"name":""}`, 422},
+		{"POST", "/api/v1/tags", `{"name":"Garden","color":"#228B22"}`, 201},
+		{"POST", "/api/v1/tags/" + tags["home"].ID + "/merge", `{"into":"` + tags["home"].ID + `"}`, 422},
+		{"POST", "/api/v1/tags/" + tags["home"].ID + "/merge", `{"into":"missing"}`, 422},
+		{"GET", "/api/v1/tags/" + tags["job"].ID, "", 404},
+	}
+	for _, tt := range tests {
+		if w := send(t, testAdmin, tt.method, tt.target, tt.body); w.Code != tt.status {
+			t.Errorf("%s %s %s: expected status code %d, got %d: %s", tt.method, tt.target, tt.body, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (s TodoSort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// parseTodoSort reads a sort parameter such as "title" or "-updatedAt". The
+// default is oldest first.
+func parseTodoSort(s string) (TodoSort, error) {
+	if s == "" {
+		return TodoSort{Field: sortCreatedAt}, nil
+	}
+	sort := TodoSort{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+	switch sort.Field {
+	case sortCreatedAt, sortUpdatedAt, sortTitle, sortPriority, sortPosition:
+		return sort, nil
+	}
+	return sort, errors.New("cannot sort by " + sort.Field)
+}
+
+// newTodoCursor returns the cursor pointing just past todo in sort order.
+func newTodoCursor(todo *Todo, sort TodoSort) *TodoCursor {
+	cursor := &TodoCursor{Sort: sort.String(), ID: todo.ID}
+	switch sort.Field {
+	case sortCreatedAt:
+		cursor.Time = todo.CreatedAt
+	case sortUpdatedAt:
+		cursor.Time = todo.UpdatedAt
+	case sortTitle:
+		cursor.Title = todo.Title
+	case sortPriority:
+		cursor.Priority = todo.Priority
+	case sortPosition:
+		cursor.Position = todo.Position
+	}
+	return cursor
+}
+
+// parseTime reads an RFC 3339 query parameter, returning the zero time if it
+// is absent.
+func parseTime(r *http.Request, name string) (time.Time, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, errors.New(name + " must be an RFC 3339 timestamp")
+	}
+	return t, nil
+}
+
+// parseTodoFilter reads the list parameters of GET /api/v1/todos:
+//
+//	status         comma-separated statuses
+//	q              text the title must contain
+//	createdAfter   RFC 3339 timestamps bounding createdAt and updatedAt
+//	createdBefore
+//	updatedAfter
+//	updatedBefore
+//	dueAfter       RFC 3339 timestamps bounding dueAt
+//	dueBefore
+//	overdue        true for incomplete todos that are past due
+//	tagsAny        comma-separated tags, of which todos need at least one
+//	tagsAll        comma-separated tags todos need all of
+//	tagsNone       comma-separated tags todos must not have
+//	sort           createdAt, updatedAt, title, priority or position (the
+//	               order set by moving todos), prefixed with - for descending
+//	limit          page size
+//	cursor         the X-Next-Cursor of the previous page
+//
+// Ownership is decided by the caller.
+func parseTodoFilter(r *http.Request) (TodoFilter, error) {
+	query := r.URL.Query()
+	filter := TodoFilter{Text: query.Get("q")}
+	if s := query.Get("status"); s != "" {
+		for _, status := range strings.Split(s, ",") {
+			filter.Statuses = append(filter.Statuses, TodoStatus(status))
+		}
+	}
+
+	tags := []struct {
+		name string
+		tags *[]string
+	}{
+		{"tagsAny", &filter.TagsAny},
+		{"tagsAll", &filter.TagsAll},
+		{"tagsNone", &filter.TagsNone},
+	}
+	for _, t := range tags {
+		if s := query.Get(t.name); s != "" {
+			for _, tag := range strings.Split(s, ",") {
+				*t.tags = append(*t.tags, normalizeTag(tag))
+			}
+		}
+	}
+
+	var err error
+	bounds := []struct {
+		name string
+		t    *time.Time
+	}{
+		{"createdAfter", &filter.CreatedAfter},
+		{"createdBefore", &filter.CreatedBefore},
+		{"updatedAfter", &filter.UpdatedAfter},
+		{"updatedBefore", &filter.UpdatedBefore},
+		{"dueAfter", &filter.DueAfter},
+		{"dueBefore", &filter.DueBefore},
+	}
+	for _, b := range bounds {
+		*b.t, err = parseTime(r, b.name)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	switch query.Get("overdue") {
+	case "":
+	case "true":
+		now := time.Now()
+		if filter.DueBefore.IsZero() || now.Before(filter.DueBefore) {
+			filter.DueBefore = now
+		}
+		filter.Incomplete = true
+	default:
+		return filter, errors.New("overdue can only be true")
+	}
+
+	filter.Sort, err = parseTodoSort(query.Get("sort"))
+	if err != nil {
+		return filter, err
+	}
+	filter.Limit, err = parseLimit(r)
+	if err != nil {
+		return filter, errors.New("limit must be a positive number")
+	}
+	if s := query.Get("cursor"); s != "" {
+		filter.After = &TodoCursor{}
+		err = decodeCursor(s, filter.After)
+		if err != nil || filter.After.Sort != filter.Sort.String() {
+			return filter, errors.New("invalid cursor for this sort order")
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func listTodos(t *testing.T, user *User, path string) ([]*Todo, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := send(t, user, "GET", path, "")
+	todos := []*Todo{}
+	if w.Code == 200 {
+		json.NewDecoder(w.Body).Decode(&todos)
+	}
+	return todos, w
+}
+
+func todoIDs(todos []*Todo) string {
+	ids := ""
+	for _, todo := range todos {
+		ids += todo.ID
+	}
+	return ids
+}
+
+func TestListTodosFiltersAndPages(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	alice := &User{ID: "alice", Scope: []string{scopeTodosRead}}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	titles := []string{"Buy milk", "Call mom", "buy bread", "Fix bike", "Walk dog"}
+	for i, title := range titles {
+		status := StatusNew
+		if i%2 == 1 {
+			status = StatusDone
+		}
+		todoStore.CreateTodo(ctx, &Todo{
+			ID:        fmt.Sprint(i),
+			Title:     title,
+			Status:    status,
+			OwnerID:   "alice",
+			CreatedAt: base.Add(time.Duration(i) * time.Hour),
+			UpdatedAt: base.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	todoStore.CreateTodo(ctx, &Todo{ID: "bob", Title: "Buy milk", OwnerID: "bob"})
+
+	// Walk the pages through the Link header
+	path := "/api/v1/todos?limit=2"
+	ids := ""
+	pages := 0
+	for path != "" {
+		todos, w := listTodos(t, alice, path)
+		if w.Code != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+		}
+		ids += todoIDs(todos)
+		pages++
+		path = ""
+		if link := w.Header().Get("Link"); link != "" {
+			fmt.Sscanf(link, "<%s", &path)
+			path = path[:len(path)-2]
+		}
+	}
+	if ids != "01234" || pages != 3 {
+		t.Errorf("Expected 01234 over 3 pages, got %s over %d", ids, pages)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/todos?status=done", "13"},
+		{"/api/v1/todos?status=new,done&sort=-createdAt", "43210"},
+		{"/api/v1/todos?q=BUY", "02"},
+		{"/api/v1/todos?sort=title", "01342"},
+		{"/api/v1/todos?sort=-title&limit=2", "24"},
+		{"/api/v1/todos?createdAfter=2026-01-01T01:00:00Z&createdBefore=2026-01-01T03:00:00Z", "12"},
+		{"/api/v1/todos?updatedAfter=2026-01-01T04:00:00Z", "4"},
+	}
+	for _, tt := range tests {
+		todos, w := listTodos(t, alice, tt.path)
+		if w.Code != 200 || todoIDs(todos) != tt.want {
+			t.Errorf("%s: Expected %s, got %d %s", tt.path, tt.want, w.Code, todoIDs(todos))
+		}
+	}
+
+	for _, path := range []string{
+		"/api/v1/todos?sort=owner",
+		"/api/v1/todos?limit=0",
+		"/api/v1/todos?createdAfter=yesterday",
+		"/api/v1/todos?cursor=garbage",
+	} {
+		_, w := listTodos(t, alice, path)
+		if w.Code != 400 {
+			t.Errorf("%s: Expected status code 400, got %d", path, w.Code)
+		}
+	}
+}
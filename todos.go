@@ -2,168 +2,451 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
+// Todo is a task owned by a user. The ID, version and the created, updated,
+// started and completed times are set by the server.
 type Todo struct {
-	ID     string `json:"id" bson:"_id"`
-	Title  string `json:"title"`
-	Status string `json:"status"`
-	Owner  *User  `json:"owner"`
+	ID    string `json:"id" bson:"_id"`
+	Title string `json:"title" validate:"required,max=200"`
+	// Status only moves along the workflow.
+	Status  TodoStatus `json:"status" validate:"status"`
+	OwnerID string     `json:"ownerId" bson:"ownerId" validate:"max=64"`
+	// Owner is only filled in on responses, when the client asks for
+	// ?expand=owner, and is never stored.
+	Owner       *UserSummary `json:"owner,omitempty" bson:"-"`
+	CreatedAt   time.Time    `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time    `json:"updatedAt" bson:"updatedAt"`
+	CreatedBy   string       `json:"createdBy" bson:"createdBy"`
+	StartedAt   *time.Time   `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	CompletedAt *time.Time   `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	// DueAt and RemindAt are set by the client and shown in TimeZone, an IANA
+	// zone name.
+	DueAt    *time.Time `json:"dueAt,omitempty" bson:"dueAt,omitempty"`
+	RemindAt *time.Time `json:"remindAt,omitempty" bson:"remindAt,omitempty"`
+	TimeZone string     `json:"timeZone,omitempty" bson:"timeZone,omitempty" validate:"timezone"`
+	// Priority is one of the Priority constants.
+	Priority int `json:"priority" bson:"priority" validate:"min=0,max=3"`
+	// Position orders the owner's todos by hand and only changes when the todo
+	// is moved.
+	Position string `json:"position" bson:"position"`
+	// Tags name tags of the owner, which are created as they are first used.
+	Tags []string `json:"tags" bson:"tags" validate:"max=20,tag"`
+	// ParentID makes the todo a subtask of that todo.
+	ParentID string `json:"parentId,omitempty" bson:"parentId,omitempty" validate:"max=64"`
+	// BlockedBy lists the todos that must be done before this one.
+	BlockedBy []string `json:"blockedBy,omitempty" bson:"blockedBy,omitempty" validate:"max=50"`
+	// Recurrence schedules the todo's next occurrence when it is completed.
+	Recurrence *Recurrence `json:"recurrence,omitempty" bson:"recurrence,omitempty"`
+	// Progress rolls up the todo's subtasks on reads and is never stored.
+	Progress *Progress `json:"progress,omitempty" bson:"-"`
+	Version  int64     `json:"version" bson:"version"`
 }
 
-func getTodos(w http.ResponseWriter, r *http.Request) {
-	log.Println("Getting todos...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+// canAccessTodo reports whether the caller owns todo or administers todos.
+func canAccessTodo(claims *TodoClaims, todo *Todo) bool {
+	if claims.HasScope(scopeTodosAdmin) {
+		return true
+	}
+	return todo.OwnerID == claims.ID
+}
+
+// resolveOwner settles the owner of a todo being written. Older clients send
+// the owner as an object instead of ownerId, so that is still accepted, and
+// fallback is used when neither is given. It writes the error response and
+// returns false if the owner is not allowed or doesn't exist.
+func resolveOwner(w http.ResponseWriter, r *http.Request, todo *Todo, fallback string) bool {
+	if todo.OwnerID == "" && todo.Owner != nil {
+		todo.OwnerID = todo.Owner.ID
+	}
+	if todo.OwnerID == "" {
+		todo.OwnerID = fallback
+	}
+	todo.Owner = nil
+	if !canAccessTodo(claimsFromContext(r.Context()), todo) {
+		writeError(w, r, forbidden("cannot assign todos to other users"))
+		return false
+	}
+	_, err := userStore.GetUser(r.Context(), todo.OwnerID)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		writeError(w, r, internalError("could not find owner", err))
+		return false
+	}
+	if err != nil {
+		log.Printf("could not find owner %s: %s\n", todo.OwnerID, err)
+		writeError(w, r, validationFailed(FieldError{Field: "ownerId", Code: "owner_not_found", Message: "owner " + todo.OwnerID + " does not exist"}))
+		return false
+	}
+	return true
+}
+
+// expandOwners fills in Owner on todos if the request asks for ?expand=owner.
+// Owners that no longer exist are left empty.
+func expandOwners(r *http.Request, todos ...*Todo) {
+	if r.URL.Query().Get("expand") != "owner" {
 		return
 	}
-	coll := client.Database(viper.GetString("mongo.db")).Collection("todos")
-	cursor, err := coll.Find(r.Context(), bson.M{})
+	owners := map[string]*UserSummary{}
+	for _, todo := range todos {
+		owner, ok := owners[todo.OwnerID]
+		if !ok {
+			user, err := userStore.GetUser(r.Context(), todo.OwnerID)
+			if err == nil {
+				owner = newUserSummary(user)
+			}
+			owners[todo.OwnerID] = owner
+		}
+		todo.Owner = owner
+	}
+}
+
+// todoETag is the entity tag of todo as it is sent. An expanded owner is
+// part of the response but changes without the todo being written, so its
+// version is part of the tag too.
+func todoETag(todo *Todo) string {
+	if todo.Owner == nil {
+		return etag(todo.Version)
+	}
+	return `"` + strconv.FormatInt(todo.Version, 10) + "." + strconv.FormatInt(todo.Owner.version, 10) + `"`
+}
+
+// getAccessibleTodo loads the todo named in the URL and checks the caller may
+// access it. It writes the error response and returns nil if not.
+func getAccessibleTodo(w http.ResponseWriter, r *http.Request) *Todo {
+	params := mux.Vars(r)
+	todoID := params["todoID"]
+	if todoID == "" {
+		writeError(w, r, badRequest("todoID is required", nil))
+		return nil
+	}
+	todo, err := todoStore.GetTodo(r.Context(), todoID)
 	if err != nil {
-		http.Error(w, "could not find todos: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, storeError("could not find todo", err))
+		return nil
+	}
+	claims := claimsFromContext(r.Context())
+	if !canAccessTodo(claims, todo) {
+		log.Printf("user %s cannot access todo %s\n", claims.ID, todoID)
+		writeError(w, r, forbidden("cannot access todo "+todoID))
+		return nil
+	}
+	return todo
+}
+
+func getTodos(w http.ResponseWriter, r *http.Request) {
+	log.Println("Getting todos...")
+	filter, err := parseTodoFilter(r)
+	if err != nil {
+		writeError(w, r, badRequest(err.Error(), nil))
 		return
 	}
-	defer cursor.Close(r.Context())
-	todos := []*Todo{}
-	for cursor.Next(r.Context()) {
-		todo := &Todo{}
-		err := cursor.Decode(todo)
-		if err != nil {
-			http.Error(w, "could not decode todo: "+err.Error(), http.StatusInternalServerError)
+	claims := claimsFromContext(r.Context())
+	// Callers see their own todos. Admins may ask for another owner's todos
+	// with ?owner=<userID> or for everyone's with ?all=true.
+	filter.OwnerID = claims.ID
+	query := r.URL.Query()
+	if query.Get("all") == "true" || query.Has("owner") {
+		if !claims.HasScope(scopeTodosAdmin) {
+			writeError(w, r, newError(http.StatusForbidden, codeMissingScope, "missing scope "+scopeTodosAdmin))
 			return
 		}
-		todos = append(todos, todo)
+		filter.OwnerID = query.Get("owner")
 	}
 
-	err = cursor.Err()
+	// Ask for one extra todo to find out whether there is a next page.
+	limit := filter.Limit
+	filter.Limit++
+	todos, err := todoStore.ListTodos(r.Context(), filter)
 	if err != nil {
-		http.Error(w, "cursor error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not find todos", err))
 		return
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(todos)
+	if len(todos) > limit {
+		todos = todos[:limit]
+		cursor, err := encodeCursor(newTodoCursor(todos[limit-1], filter.Sort))
+		if err != nil {
+			writeError(w, r, internalError("could not encode cursor", err))
+			return
+		}
+		setNextPage(w, r, cursor)
+	}
+	err = fillProgress(r, todos...)
 	if err != nil {
-		http.Error(w, "could not encode todos: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not count subtasks", err))
 		return
 	}
+	expandOwners(r, todos...)
+
+	writeJSON(w, r, http.StatusOK, todos)
 }
 
 func getTodo(w http.ResponseWriter, r *http.Request) {
 	log.Println("Getting todo...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
-	params := mux.Vars(r)
-	todoID := params["todoID"]
-	if todoID == "" {
-		log.Println("todoID is required")
-		http.Error(w, "todoID is required", http.StatusBadRequest)
+	todo := getAccessibleTodo(w, r)
+	if todo == nil {
 		return
 	}
-	coll := client.Database(viper.GetString("mongo.db")).Collection("todos")
-	todo := &Todo{}
-	err := coll.FindOne(r.Context(), bson.M{"_id": todoID}).Decode(todo)
-	if err != nil {
-		http.Error(w, "could not find todo: "+err.Error(), http.StatusInternalServerError)
+	expandOwners(r, todo)
+	if notModifiedETag(w, r, todoETag(todo)) {
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(todo)
+	err := fillProgress(r, todo)
 	if err != nil {
-		http.Error(w, "could not encode todo: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not count subtasks", err))
 		return
 	}
+	writeJSON(w, r, http.StatusOK, todo)
 }
 
 func createTodo(w http.ResponseWriter, r *http.Request) {
 	log.Println("Creating todo...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
 	todo := &Todo{}
 	err := json.NewDecoder(r.Body).Decode(todo)
 	if err != nil {
-		http.Error(w, "could not decode todo: "+err.Error(), http.StatusBadRequest)
+		writeError(w, r, badRequest("could not decode todo", err))
+		return
+	}
+	normalizeTags(todo)
+	if !checkValid(w, r, todo, checkDueDates(todo)...) {
+		return
+	}
+	normalizeDueDates(todo)
+	claims := claimsFromContext(r.Context())
+	if !resolveOwner(w, r, todo, claims.ID) || !checkParent(w, r, todo) || !checkBlockers(w, r, todo) {
+		return
+	}
+	if todo.Status == "" {
+		todo.Status = workflow.Initial
+	}
+	if todo.Status != workflow.Initial {
+		writeError(w, r, validationFailed(FieldError{Field: "status", Code: "invalid_status", Message: "new todos must start as " + string(workflow.Initial)}))
+		return
+	}
+	todo.StartedAt = nil
+	todo.CompletedAt = nil
+	todo.ID, err = newID()
+	if err != nil {
+		writeError(w, r, internalError("could not generate id", err))
 		return
 	}
-	coll := client.Database(viper.GetString("mongo.db")).Collection("todos")
-	_, err = coll.InsertOne(r.Context(), todo)
+	// New todos go to the end of the owner's list.
+	todo.Position, err = endPosition(r.Context(), todo.OwnerID)
 	if err != nil {
-		http.Error(w, "could not create todo: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not place todo", err))
+		return
+	}
+	keepSeries(nil, todo)
+	todo.CreatedAt = currentTime()
+	todo.UpdatedAt = todo.CreatedAt
+	todo.CreatedBy = claims.ID
+	todo.Version = 1
+	if !ensureTags(w, r, todo) {
+		return
+	}
+	err = todoStore.CreateTodo(r.Context(), todo)
+	if errors.Is(err, ErrDuplicate) {
+		writeError(w, r, newError(http.StatusConflict, codeConflict, "todo "+todo.ID+" already exists"))
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(todo)
 	if err != nil {
-		http.Error(w, "could not encode todo: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not create todo", err))
 		return
 	}
+	touchParents(r.Context(), nil, todo)
+	w.Header().Set("Location", "/api/v1/todos/"+todo.ID)
+	w.Header().Set("ETag", etag(todo.Version))
+	writeJSON(w, r, http.StatusCreated, todo)
 }
 
 func updateTodo(w http.ResponseWriter, r *http.Request) {
 	log.Println("Updating todo...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
-	params := mux.Vars(r)
-	todoID := params["todoID"]
-	if todoID == "" {
-		log.Println("todoID is required")
-		http.Error(w, "todoID is required", http.StatusBadRequest)
+	existing := getAccessibleTodo(w, r)
+	if existing == nil || !checkIfMatch(w, r, existing.Version) {
 		return
 	}
 	todo := &Todo{}
 	err := json.NewDecoder(r.Body).Decode(todo)
 	if err != nil {
-		http.Error(w, "could not decode todo: "+err.Error(), http.StatusBadRequest)
+		writeError(w, r, badRequest("could not decode todo", err))
+		return
+	}
+	saveTodo(w, r, existing, todo)
+}
+
+// patchTodo applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// to a todo. The patch applies to the todo as returned by GET, and the result
+// is checked and stored like a PUT, in a single write against the version
+// that was patched.
+func patchTodo(w http.ResponseWriter, r *http.Request) {
+	log.Println("Patching todo...")
+	if !checkPatchType(w, r) {
+		return
+	}
+	existing := getAccessibleTodo(w, r)
+	if existing == nil || !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	doc, err := json.Marshal(existing)
+	if err != nil {
+		writeError(w, r, internalError("could not encode todo", err))
 		return
 	}
-	coll := client.Database(viper.GetString("mongo.db")).Collection("todos")
-	_, err = coll.ReplaceOne(r.Context(), bson.M{"_id": todoID}, todo)
+	doc, err = patchRequest(r, doc)
 	if err != nil {
-		http.Error(w, "could not update todo: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(todo)
+	todo := &Todo{}
+	err = json.Unmarshal(doc, todo)
 	if err != nil {
-		http.Error(w, "could not encode todo: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, &APIError{Status: http.StatusUnprocessableEntity, Code: codeValidationFailed, Detail: "the patched todo is not valid", Err: err})
 		return
 	}
+
+	saveTodo(w, r, existing, todo)
 }
 
-func deleteTodo(w http.ResponseWriter, r *http.Request) {
-	log.Println("Deleting todo...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+// saveTodo stores todo in place of existing. The ID, creation fields,
+// status timestamps and position are kept from existing, an empty status
+// keeps the current one, and the status may only move along the workflow.
+// A todo given to another owner goes to the end of their list, and a todo
+// completed here must be unblocked and completes its subtasks, as
+// checkUnblocked and openSubtasks allow, and schedules its next occurrence
+// if it recurs.
+func saveTodo(w http.ResponseWriter, r *http.Request, existing *Todo, todo *Todo) {
+	normalizeTags(todo)
+	if !checkValid(w, r, todo, checkDueDates(todo)...) {
 		return
 	}
-	params := mux.Vars(r)
-	todoID := params["todoID"]
-	if todoID == "" {
-		log.Println("todoID is required")
-		http.Error(w, "todoID is required", http.StatusBadRequest)
+	normalizeDueDates(todo)
+	todo.ID = existing.ID
+	todo.CreatedAt = existing.CreatedAt
+	todo.CreatedBy = existing.CreatedBy
+	todo.Version = existing.Version
+	todo.UpdatedAt = currentTime()
+	keepSeries(existing, todo)
+	if !resolveOwner(w, r, todo, existing.OwnerID) || !checkParent(w, r, todo) || !checkBlockers(w, r, todo) {
+		return
+	}
+	todo.Position = existing.Position
+	if todo.OwnerID != existing.OwnerID {
+		// Subtasks share their parent's owner.
+		progress, err := todoStore.CountSubtasks(r.Context(), []string{todo.ID})
+		if err != nil {
+			writeError(w, r, internalError("could not count subtasks", err))
+			return
+		}
+		if progress[todo.ID] != nil {
+			writeError(w, r, validationFailed(FieldError{Field: "ownerId", Code: "has_subtasks", Message: "cannot change the owner of a todo with subtasks"}))
+			return
+		}
+		todo.Position, err = endPosition(r.Context(), todo.OwnerID)
+		if err != nil {
+			writeError(w, r, internalError("could not place todo", err))
+			return
+		}
+	}
+	if todo.Status == "" {
+		todo.Status = existing.Status
+	}
+	if !checkTransition(w, r, existing, todo.Status) {
+		return
+	}
+	status := todo.Status
+	todo.Status = existing.Status
+	todo.StartedAt = existing.StartedAt
+	todo.CompletedAt = existing.CompletedAt
+	if status != existing.Status {
+		setStatus(todo, status, todo.UpdatedAt)
+	}
+	var open []*Todo
+	completing := status == StatusDone && existing.Status != StatusDone
+	if completing {
+		var ok bool
+		if !checkUnblocked(w, r, todo) {
+			return
+		}
+		if open, ok = openSubtasks(w, r, todo); !ok {
+			return
+		}
+	}
+	if !ensureTags(w, r, todo) {
 		return
 	}
-	coll := client.Database(viper.GetString("mongo.db")).Collection("todos")
-	_, err := coll.DeleteOne(r.Context(), bson.M{"_id": todoID})
+	err := todoStore.UpdateTodo(r.Context(), todo.ID, todo)
 	if err != nil {
-		http.Error(w, "could not delete todo: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, storeError("could not update todo", err))
+		return
+	}
+	// Only a completion that was stored schedules the next occurrence.
+	if completing {
+		if _, ok := scheduleNext(w, r, todo); !ok {
+			return
+		}
+	}
+	if !completeSubtasks(w, r, todo, open, todo.UpdatedAt) {
+		return
+	}
+	touchParents(r.Context(), existing, todo)
+	w.Header().Set("ETag", etag(todo.Version))
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+func deleteTodo(w http.ResponseWriter, r *http.Request) {
+	log.Println("Deleting todo...")
+	todo := getAccessibleTodo(w, r)
+	if todo == nil || !checkIfMatch(w, r, todo.Version) {
+		return
+	}
+	if !removeTodo(w, r, todo) {
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// removeTodo deletes todo and, as deleteSubtasks allows, its subtasks, along
+// with their comments. It writes the error response and returns false if
+// that fails.
+func removeTodo(w http.ResponseWriter, r *http.Request, todo *Todo) bool {
+	subtasks, ok := deleteSubtasks(w, r, todo)
+	if !ok {
+		return false
+	}
+	err := todoStore.DeleteTodo(r.Context(), todo.ID, todo.Version)
+	if err != nil {
+		writeError(w, r, storeError("could not delete todo", err))
+		return false
+	}
+	touchParents(r.Context(), todo, nil)
+	for _, subtask := range subtasks {
+		err = todoStore.DeleteTodo(r.Context(), subtask.ID, 0)
+		if err != nil && !errors.Is(err, ErrTodoNotFound) {
+			writeError(w, r, internalError("could not delete subtask "+subtask.ID, err))
+			return false
+		}
+	}
+	// Deleted todos no longer block anything, and their comments go too.
+	ids := []string{}
+	for _, deleted := range append(subtasks, todo) {
+		ids = append(ids, deleted.ID)
+		err = todoStore.RemoveBlocker(r.Context(), deleted.ID)
+		if err != nil {
+			writeError(w, r, internalError("could not unblock todos", err))
+			return false
+		}
+	}
+	err = commentStore.DeleteCommentsByTodos(r.Context(), ids)
+	if err != nil {
+		writeError(w, r, internalError("could not delete comments", err))
+		return false
+	}
+	return true
+}
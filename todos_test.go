@@ -3,60 +3,34 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
 	"net/http/httptest"
 	"testing"
-
-	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	viper.SetConfigName("settings")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatalf("Error reading config file: %s\n", err)
-	}
-}
-
 func TestGetTodos(t *testing.T) {
+	setupStores(t)
 	ctx := context.Background()
-	var err error
-	client, err = getMongoClient(ctx)
-	if err != nil {
-		t.Fatalf("Error connecting to MongoDB: %s\n", err)
-	}
-	defer client.Disconnect(ctx)
 
 	// Create a todo
-	coll := getTodosCollection(client)
 	user := &User{
-		ID:   "testuser",
-		Name: "Alice",
+		ID:    "testuser",
+		Name:  "Alice",
+		Scope: []string{scopeTodosRead},
 	}
 	todo := &Todo{
-		ID:     "testtodo",
-		Title:  "Test Todo",
-		Status: "status",
-		Owner:  user,
+		ID:      "testtodo",
+		Title:   "Test Todo",
+		Status:  "status",
+		OwnerID: user.ID,
 	}
-	_, err = coll.UpdateOne(
-		ctx,
-		bson.M{"_id": todo.ID},
-		bson.M{"$set": todo},
-		options.Update().SetUpsert(true),
-	)
+	todoStore.DeleteTodo(ctx, todo.ID, 0)
+	err := todoStore.CreateTodo(ctx, todo)
 	if err != nil {
 		t.Fatalf("Error creating todo: %s\n", err)
 	}
 
 	// Get the todos
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/api/v1/todos", nil)
-	getTodos(w, r)
+	w := send(t, user, "GET", "/api/v1/todos", "")
 
 	if w.Code != 200 {
 		t.Errorf("Expected status code 200, got %d", w.Code)
@@ -81,7 +55,107 @@ func TestGetTodos(t *testing.T) {
 		t.Errorf("Expected to find testtodo, got %v", todos)
 	}
 
-	coll.DeleteOne(ctx, bson.M{"_id": "testtodo"})
+	todoStore.DeleteTodo(ctx, "testtodo", 0)
+}
+
+func TestTodosAreOwnerScoped(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+
+	alice := &User{ID: "alice", Scope: []string{scopeTodosRead, scopeTodosWrite}}
+	bob := &User{ID: "bob", Scope: []string{scopeTodosRead, scopeTodosWrite}}
+	createTestUser(t, alice)
+	createTestUser(t, bob)
+	todoStore.CreateTodo(ctx, &Todo{ID: "a1", Title: "Alice's", OwnerID: alice.ID})
+	todoStore.CreateTodo(ctx, &Todo{ID: "b1", Title: "Bob's", OwnerID: bob.ID})
+
+	// Alice only sees her own todos
+	w := send(t, alice, "GET", "/api/v1/todos", "")
+	todos := []*Todo{}
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 1 || todos[0].ID != "a1" {
+		t.Errorf("Expected only a1, got %v", todos)
+	}
+
+	// Listing everyone's todos needs todos:admin
+	w = send(t, alice, "GET", "/api/v1/todos?all=true", "")
+	if w.Code != 403 {
+		t.Errorf("Expected status code 403, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "GET", "/api/v1/todos?all=true", "")
+	todos = []*Todo{}
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 2 {
+		t.Errorf("Expected 2 todos, got %d", len(todos))
+	}
+
+	// Alice can't read, update or delete Bob's todo
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		w = send(t, alice, method, "/api/v1/todos/b1", `{"title":"Mine now"}`)
+		if w.Code != 403 {
+			t.Errorf("%s: Expected status code 403, got %d", method, w.Code)
+		}
+	}
+
+	// Alice can't hand her todo to Bob
+	for _, body := range []string{`{"title":"Yours","ownerId":"bob"}`, `{"title":"Yours","owner":{"id":"bob"}}`} {
+		w = send(t, alice, "PUT", "/api/v1/todos/a1", body)
+		if w.Code != 403 {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	}
+}
+
+func TestTodoOwnerReference(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	alice := &User{ID: "alice", Name: "Alice", Username: "alice", Scope: []string{scopeTodosRead, scopeTodosWrite}}
+	createTestUser(t, alice)
+
+	// The owner defaults to the caller
+	w := send(t, alice, "POST", "/api/v1/todos", `{"title":"Write tests"}`)
+	todoID := createdID(t, w)
+	todo, _ := todoStore.GetTodo(ctx, todoID)
+	if todo.OwnerID != "alice" || todo.CreatedBy != "alice" {
+		t.Errorf("Expected owner and creator alice, got %+v", todo)
+	}
+
+	// Owners must exist
+	w = send(t, testAdmin, "POST", "/api/v1/todos", `{"title":"Orphan","ownerId":"ghost"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected status code 422, got %d", w.Code)
+	}
+
+	// Renames show up in expanded owners, and change their ETag
+	w = send(t, alice, "GET", "/api/v1/todos/"+todoID+"?expand=owner", "")
+	tag := w.Header().Get("ETag")
+	if tag == send(t, alice, "GET", "/api/v1/todos/"+todoID, "").Header().Get("ETag") {
+		t.Errorf("Expected the expanded todo to have its own ETag, got %s for both", tag)
+	}
+	userStore.UpdateUser(ctx, "alice", &User{ID: "alice", Name: "Alicia", Username: "alice"})
+	w = send(t, alice, "GET", "/api/v1/todos/"+todoID+"?expand=owner", "", "If-None-Match", tag)
+	if w.Code != 200 {
+		t.Errorf("Expected status code 200 after the owner was renamed, got %d", w.Code)
+	}
+	todo = &Todo{}
+	json.NewDecoder(w.Body).Decode(todo)
+	if todo.Owner == nil || todo.Owner.Name != "Alicia" {
+		t.Errorf("Expected expanded owner Alicia, got %+v", todo.Owner)
+	}
+
+	// Users with todos are only deleted with ?cascade=true
+	w = send(t, testAdmin, "DELETE", "/api/v1/users/alice", "")
+	if w.Code != 409 {
+		t.Errorf("Expected status code 409, got %d", w.Code)
+	}
+	w = send(t, testAdmin, "DELETE", "/api/v1/users/alice?cascade=true", "")
+	if w.Code != 204 {
+		t.Errorf("Expected status code 204, got %d", w.Code)
+	}
+	todos, _ := todoStore.ListTodos(ctx, TodoFilter{OwnerID: "alice"})
+	if len(todos) != 0 {
+		t.Errorf("Expected alice's todos to be deleted, got %d", len(todos))
+	}
 }
 
 /* func TestGetUser(t *testing.T) {
@@ -253,3 +327,61 @@ func TestDeleteUser(t *testing.T) {
 		t.Errorf("Expected nothing, got %s", user.Name)
 	}
 } */
+
+func TestPatchTodo(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	createTestUser(t, testAdmin)
+	todo := &Todo{ID: "t1", Title: "Patch me", Status: StatusNew, OwnerID: testAdmin.ID, Version: 1}
+	todoStore.CreateTodo(ctx, todo)
+
+	patch := func(contentType, body string) *httptest.ResponseRecorder {
+		return send(t, testAdmin, "PATCH", "/api/v1/todos/t1", body, "Content-Type", contentType)
+	}
+
+	// A merge patch changes the status without resending the rest
+	w := patch("application/merge-patch+json", `{"status":"started"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	stored, _ := todoStore.GetTodo(ctx, "t1")
+	if stored.Status != StatusStarted || stored.Title != "Patch me" || stored.StartedAt == nil || stored.Version != 2 {
+		t.Errorf("Expected only the status to change, got %+v", stored)
+	}
+
+	// JSON Patch operations apply together or not at all
+	w = patch("application/json-patch+json", `[{"op":"replace","path":"/title","value":"Patched"},{"op":"test","path":"/status","value":"new"}]`)
+	if w.Code != 422 {
+		t.Errorf("Expected a failed test to get 422, got %d: %s", w.Code, w.Body.String())
+	}
+	stored, _ = todoStore.GetTodo(ctx, "t1")
+	if stored.Title != "Patch me" {
+		t.Errorf("Expected a failed patch to change nothing, got %+v", stored)
+	}
+	w = patch("application/json-patch+json", `[{"op":"test","path":"/status","value":"started"},{"op":"replace","path":"/title","value":"Patched"},{"op":"replace","path":"/status","value":"done"}]`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	stored, _ = todoStore.GetTodo(ctx, "t1")
+	if stored.Title != "Patched" || stored.Status != StatusDone || stored.CompletedAt == nil {
+		t.Errorf("Expected title and status to change, got %+v", stored)
+	}
+
+	// The patched todo is validated like a PUT
+	tests := []struct {
+		contentType, body string
+		status            int
+	}{
+		{"application/merge-patch+json", `{"status":"started"}`, 422},
+		{"application/merge-patch+json", `{"ownerId":"ghost"}`, 422},
+		{"application/merge-patch+json", `{"title":42}`, 422},
+		{"application/json-patch+json", `{"op":"add"}`, 400},
+		{"text/plain", `{}`, 415},
+	}
+	for _, tt := range tests {
+		w = patch(tt.contentType, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status code %d, got %d: %s", tt.contentType, tt.body, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
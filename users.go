@@ -2,192 +2,522 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// User is the stored user. Password holds the bcrypt hash and is never
+// serialized to JSON; clients send passwords in a UserRequest and get a
+// UserResponse back.
 type User struct {
-	ID       string   `json:"id" bson:"_id"`
-	Name     string   `json:"name"`
-	Username string   `json:"username"`
-	Password string   `json:"password"`
-	Scope    []string `json:"scope"`
+	ID        string    `json:"id" bson:"_id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Password  string    `json:"-" bson:"password"`
+	Scope     []string  `json:"scope"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	CreatedBy string    `json:"createdBy" bson:"createdBy"`
+	Version   int64     `json:"version" bson:"version"`
+}
+
+// UserRequest is the body of create and update requests. IDs and timestamps
+// are set by the server.
+type UserRequest struct {
+	Name     string   `json:"name" validate:"max=100"`
+	Username string   `json:"username" validate:"required,min=3,max=32,username"`
+	Password string   `json:"password" validate:"maxbytes=72"`
+	Scope    []string `json:"scope" validate:"scope"`
+}
+
+// UserResponse is the public representation of a user.
+type UserResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Scope     []string  `json:"scope"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	CreatedBy string    `json:"createdBy"`
+	Version   int64     `json:"version"`
+}
+
+// UserSummary is the short form of a user embedded in other resources.
+type UserSummary struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	// version is the user's, for the entity tags of resources that embed
+	// the summary.
+	version int64
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword" validate:"required,maxbytes=72"`
+}
+
+// HasScope reports whether the user has been granted scope.
+func (u *User) HasScope(scope string) bool {
+	for _, s := range u.Scope {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func newUserResponse(user *User) *UserResponse {
+	return &UserResponse{
+		ID:        user.ID,
+		Name:      user.Name,
+		Username:  user.Username,
+		Scope:     user.Scope,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		CreatedBy: user.CreatedBy,
+		Version:   user.Version,
+	}
+}
+
+func newUserSummary(user *User) *UserSummary {
+	return &UserSummary{
+		ID:       user.ID,
+		Name:     user.Name,
+		Username: user.Username,
+		version:  user.Version,
+	}
+}
+
+func (ur *UserRequest) toUser() *User {
+	return &User{
+		Name:     ur.Name,
+		Username: ur.Username,
+		Password: ur.Password,
+		Scope:    ur.Scope,
+	}
 }
 
 func getUsers(w http.ResponseWriter, r *http.Request) {
 	log.Println("Getting users...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeError(w, r, badRequest(err.Error(), nil))
 		return
 	}
-	coll := client.Database(viper.GetString("mongo.db")).Collection("users")
-	cursor, err := coll.Find(r.Context(), bson.M{})
+
+	// Ask for one extra user to find out whether there is a next page.
+	limit := filter.Limit
+	filter.Limit++
+	users, err := userStore.ListUsers(r.Context(), filter)
 	if err != nil {
-		http.Error(w, "could not find users: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not find users", err))
 		return
 	}
-	defer cursor.Close(r.Context())
-	users := []*User{}
-	for cursor.Next(r.Context()) {
-		user := &User{}
-		err := cursor.Decode(user)
+	if len(users) > limit {
+		users = users[:limit]
+		last := users[limit-1]
+		cursor, err := encodeCursor(&UserCursor{Username: last.Username, ID: last.ID})
 		if err != nil {
-			http.Error(w, "could not decode user: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, r, internalError("could not encode cursor", err))
 			return
 		}
-		users = append(users, user)
+		setNextPage(w, r, cursor)
 	}
 
-	err = cursor.Err()
-	if err != nil {
-		http.Error(w, "cursor error: "+err.Error(), http.StatusInternalServerError)
-		return
+	resp := []*UserResponse{}
+	for _, user := range users {
+		resp = append(resp, newUserResponse(user))
 	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(users)
+// parseUserFilter reads the list parameters of GET /api/v1/users: q, a
+// name or username prefix; scope; limit; and cursor, the X-Next-Cursor of
+// the previous page.
+func parseUserFilter(r *http.Request) (UserFilter, error) {
+	query := r.URL.Query()
+	filter := UserFilter{Prefix: query.Get("q"), Scope: query.Get("scope")}
+	var err error
+	filter.Limit, err = parseLimit(r)
 	if err != nil {
-		http.Error(w, "could not encode users: "+err.Error(), http.StatusInternalServerError)
-		return
+		return filter, errors.New("limit must be a positive number")
 	}
+	if s := query.Get("cursor"); s != "" {
+		filter.After = &UserCursor{}
+		err = decodeCursor(s, filter.After)
+		if err != nil {
+			return filter, errors.New("invalid cursor")
+		}
+	}
+	return filter, nil
 }
 
 func getUser(w http.ResponseWriter, r *http.Request) {
 	log.Println("Getting user...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
 	params := mux.Vars(r)
 	userID := params["userID"]
 	if userID == "" {
-		log.Println("userID is required")
-		http.Error(w, "userID is required", http.StatusBadRequest)
+		writeError(w, r, errUserIDRequired)
 		return
 	}
 
-	coll := client.Database(viper.GetString("mongo.db")).Collection("users")
-	user := &User{}
-	err := coll.FindOne(r.Context(), bson.M{"_id": userID}).Decode(user)
+	user, err := userStore.GetUser(r.Context(), userID)
 	if err != nil {
-		log.Printf("could not find user: %s\n", err)
-		http.Error(w, "could not find user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, storeError("could not find user", err))
+		return
+	}
+	if notModified(w, r, user.Version) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(user)
+	writeJSON(w, r, http.StatusOK, newUserResponse(user))
+}
+
+// hashPassword returns the bcrypt hash of password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("could not encode user: %s\n", err)
-		http.Error(w, "could not encode user: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// sameScope reports whether a and b grant the same scopes, in any order.
+func sameScope(a, b []string) bool {
+	for _, scope := range a {
+		if !containsString(b, scope) {
+			return false
+		}
+	}
+	for _, scope := range b {
+		if !containsString(a, scope) {
+			return false
+		}
 	}
+	return true
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
 	log.Println("Creating user...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	ur := &UserRequest{}
+	err := json.NewDecoder(r.Body).Decode(ur)
+	if err != nil {
+		writeError(w, r, badRequest("could not decode user", err))
 		return
 	}
-	user := &User{}
-	err := json.NewDecoder(r.Body).Decode(user)
-	if err != nil {
-		log.Println("decode error")
-		http.Error(w, "could not decode user: "+err.Error(), http.StatusInternalServerError)
+	var missing []FieldError
+	if ur.Password == "" {
+		missing = append(missing, FieldError{Field: "password", Code: "required", Message: "is required"})
+	}
+	if !checkValid(w, r, ur, missing...) {
+		return
+	}
+	user := ur.toUser()
+	claims := claimsFromContext(r.Context())
+	if len(user.Scope) > 0 && !claims.HasScope(scopeUsersAdmin) {
+		writeError(w, r, forbidden("granting scopes needs "+scopeUsersAdmin))
 		return
 	}
 
-	bcryptPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	user.Password, err = hashPassword(user.Password)
 	if err != nil {
-		log.Println("bcrypt error")
-		http.Error(w, "could not bcrypt password: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not bcrypt password", err))
 		return
 	}
-	user.Password = string(bcryptPassword)
 
-	coll := client.Database(viper.GetString("mongo.db")).Collection("users")
-	_, err = coll.InsertOne(r.Context(), user)
+	user.ID, err = newID()
 	if err != nil {
-		log.Println("insert error")
-		http.Error(w, "could not insert user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not generate id", err))
 		return
 	}
+	user.CreatedAt = currentTime()
+	user.UpdatedAt = user.CreatedAt
+	user.CreatedBy = claims.ID
+	user.Version = 1
 
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(user)
+	err = userStore.CreateUser(r.Context(), user)
+	if errors.Is(err, ErrDuplicate) {
+		writeError(w, r, usernameTaken(user.Username))
+		return
+	}
 	if err != nil {
-		log.Println("encode error")
-		http.Error(w, "could not encode user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("could not insert user", err))
 		return
 	}
+
+	w.Header().Set("Location", "/api/v1/users/"+user.ID)
+	w.Header().Set("ETag", etag(user.Version))
+	writeJSON(w, r, http.StatusCreated, newUserResponse(user))
 }
 
-func updateUser(w http.ResponseWriter, r *http.Request) {
-	log.Println("Updating user...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
+// usernameTaken reports that another user already has username.
+func usernameTaken(username string) *APIError {
+	return &APIError{
+		Status: http.StatusConflict,
+		Code:   codeUsernameTaken,
+		Detail: "username " + username + " is taken",
+		Fields: []FieldError{{Field: "username", Code: "taken", Message: "is taken"}},
 	}
+}
+
+var errUserIDRequired = badRequest("userID is required", nil)
+
+// getExistingUser loads the user named in the URL. It writes the error
+// response and returns nil if that fails.
+func getExistingUser(w http.ResponseWriter, r *http.Request) *User {
 	params := mux.Vars(r)
 	userID := params["userID"]
 	if userID == "" {
-		log.Println("userID is required")
-		http.Error(w, "userID is required", http.StatusBadRequest)
+		writeError(w, r, errUserIDRequired)
+		return nil
+	}
+	user, err := userStore.GetUser(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, storeError("could not find user", err))
+		return nil
+	}
+	return user
+}
+
+// checkUserEdit writes a 403 response and returns false if the caller may not
+// edit user: other users may only be edited by callers holding every scope
+// they hold, so users:write can't be used to take over stronger accounts.
+func checkUserEdit(w http.ResponseWriter, r *http.Request, user *User) bool {
+	claims := claimsFromContext(r.Context())
+	if claims.ID == user.ID {
+		return true
+	}
+	for _, scope := range user.Scope {
+		if !claims.HasScope(scope) {
+			writeError(w, r, forbidden("cannot edit a user with scope "+scope))
+			return false
+		}
+	}
+	return true
+}
+
+// saveUserRequest applies ur on top of existing and stores the result. An
+// empty password keeps the current hash and a nil scope keeps the current
+// scope; changing the scope needs users:admin. Setting another user's
+// password needs users:admin too, while users change their own through
+// changePassword, which checks the current one.
+func saveUserRequest(w http.ResponseWriter, r *http.Request, existing *User, ur *UserRequest) {
+	if !checkValid(w, r, ur) || !checkUserEdit(w, r, existing) {
+		return
+	}
+	claims := claimsFromContext(r.Context())
+	if ur.Password != "" && claims.ID == existing.ID {
+		writeError(w, r, forbidden("change your own password with PUT /api/v1/users/"+existing.ID+"/password"))
+		return
+	}
+	if ur.Password != "" && !claims.HasScope(scopeUsersAdmin) {
+		writeError(w, r, forbidden("setting another user's password needs "+scopeUsersAdmin))
+		return
+	}
+	user := ur.toUser()
+	user.ID = existing.ID
+	user.CreatedAt = existing.CreatedAt
+	user.CreatedBy = existing.CreatedBy
+	user.Version = existing.Version
+	user.UpdatedAt = currentTime()
+	if user.Scope == nil {
+		user.Scope = existing.Scope
+	}
+	if !sameScope(user.Scope, existing.Scope) && !claims.HasScope(scopeUsersAdmin) {
+		writeError(w, r, forbidden("changing scopes needs "+scopeUsersAdmin))
+		return
+	}
+	if !checkUserEdit(w, r, user) {
 		return
 	}
+	if user.Password == "" {
+		user.Password = existing.Password
+	} else {
+		var err error
+		user.Password, err = hashPassword(user.Password)
+		if err != nil {
+			writeError(w, r, internalError("could not bcrypt password", err))
+			return
+		}
+	}
 
-	user := &User{}
-	err := json.NewDecoder(r.Body).Decode(user)
+	err := userStore.UpdateUser(r.Context(), user.ID, user)
+	if errors.Is(err, ErrDuplicate) {
+		writeError(w, r, usernameTaken(user.Username))
+		return
+	}
 	if err != nil {
-		http.Error(w, "could not decode user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, storeError("could not update user", err))
 		return
 	}
 
-	coll := client.Database(viper.GetString("mongo.db")).Collection("users")
-	_, err = coll.ReplaceOne(r.Context(), bson.M{"_id": userID}, user)
+	w.Header().Set("ETag", etag(user.Version))
+	writeJSON(w, r, http.StatusOK, newUserResponse(user))
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	log.Println("Updating user...")
+	existing := getExistingUser(w, r)
+	if existing == nil || !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	ur := &UserRequest{}
+	err := json.NewDecoder(r.Body).Decode(ur)
 	if err != nil {
-		http.Error(w, "could not update user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, badRequest("could not decode user", err))
+		return
+	}
+
+	saveUserRequest(w, r, existing, ur)
+}
+
+// patchUser applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// to a user. Only the fields the patch touches change.
+func patchUser(w http.ResponseWriter, r *http.Request) {
+	log.Println("Patching user...")
+	if !checkPatchType(w, r) {
+		return
+	}
+	existing := getExistingUser(w, r)
+	if existing == nil || !checkIfMatch(w, r, existing.Version) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(user)
+	doc, err := json.Marshal(newUserResponse(existing))
+	if err != nil {
+		writeError(w, r, internalError("could not encode user", err))
+		return
+	}
+	doc, err = patchRequest(r, doc)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ur := &UserRequest{}
+	err = json.Unmarshal(doc, ur)
 	if err != nil {
-		http.Error(w, "could not encode user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, &APIError{Status: http.StatusUnprocessableEntity, Code: codeValidationFailed, Detail: "the patched user is not valid", Err: err})
 		return
 	}
+
+	saveUserRequest(w, r, existing, ur)
 }
 
 func deleteUser(w http.ResponseWriter, r *http.Request) {
 	log.Println("Deleting user...")
-	if !validUser(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	user := getExistingUser(w, r)
+	if user == nil || !checkUserEdit(w, r, user) || !checkIfMatch(w, r, user.Version) {
+		return
+	}
+	userID := user.ID
+
+	// Todos reference their owner, so a user who still owns todos is only
+	// deleted along with them, and only when asked with ?cascade=true.
+	todos, err := todoStore.ListTodos(r.Context(), TodoFilter{OwnerID: userID})
+	if err != nil {
+		writeError(w, r, internalError("could not find todos", err))
+		return
+	}
+	if len(todos) > 0 {
+		if r.URL.Query().Get("cascade") != "true" {
+			writeError(w, r, newError(http.StatusConflict, codeUserHasTodos, "user still owns todos, delete with ?cascade=true to remove them too"))
+			return
+		}
+		if !claimsFromContext(r.Context()).HasScope(scopeTodosAdmin) {
+			writeError(w, r, newError(http.StatusForbidden, codeMissingScope, "missing scope "+scopeTodosAdmin))
+			return
+		}
+		err = todoStore.DeleteTodosByOwner(r.Context(), userID)
+		if err != nil {
+			writeError(w, r, internalError("could not delete todos", err))
+			return
+		}
+		ids := make([]string, len(todos))
+		for i, todo := range todos {
+			ids[i] = todo.ID
+		}
+		err = commentStore.DeleteCommentsByTodos(r.Context(), ids)
+		if err != nil {
+			writeError(w, r, internalError("could not delete comments", err))
+			return
+		}
+	}
+
+	err = tagStore.DeleteTagsByOwner(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, internalError("could not delete tags", err))
 		return
 	}
+
+	err = userStore.DeleteUser(r.Context(), userID, user.Version)
+	if err != nil {
+		writeError(w, r, storeError("could not delete user", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changePassword sets a new password for the calling user after checking the
+// current one. Refresh tokens issued under the old password are revoked.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	log.Println("Changing password...")
 	params := mux.Vars(r)
 	userID := params["userID"]
 	if userID == "" {
-		log.Println("userID is required")
-		http.Error(w, "userID is required", http.StatusBadRequest)
+		writeError(w, r, errUserIDRequired)
+		return
+	}
+	claims := claimsFromContext(r.Context())
+	if claims.ID != userID {
+		writeError(w, r, forbidden("can only change your own password"))
 		return
 	}
 
-	coll := client.Database(viper.GetString("mongo.db")).Collection("users")
-	_, err := coll.DeleteOne(r.Context(), bson.M{"_id": userID})
+	cpr := &ChangePasswordRequest{}
+	err := json.NewDecoder(r.Body).Decode(cpr)
 	if err != nil {
-		http.Error(w, "could not delete user: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, badRequest("could not decode password change", err))
 		return
 	}
+	if !checkValid(w, r, cpr) {
+		return
+	}
+
+	user, err := userStore.GetUser(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, storeError("could not find user", err))
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(cpr.CurrentPassword))
+	if err != nil {
+		writeError(w, r, newError(http.StatusForbidden, codeInvalidCredentials, "current password is incorrect"))
+		return
+	}
+
+	user.Password, err = hashPassword(cpr.NewPassword)
+	if err != nil {
+		writeError(w, r, internalError("could not bcrypt password", err))
+		return
+	}
+	user.UpdatedAt = currentTime()
+
+	err = userStore.UpdateUser(r.Context(), userID, user)
+	if err != nil {
+		writeError(w, r, storeError("could not update user", err))
+		return
+	}
+	err = tokenStore.RevokeUserRefreshTokens(r.Context(), userID)
+	if err != nil {
+		log.Printf("could not revoke refresh tokens: %s\n", err)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
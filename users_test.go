@@ -3,63 +3,47 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	viper.SetConfigName("settings")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
+// createTestUser replaces any existing user with the same ID.
+func createTestUser(t *testing.T, user *User) {
+	t.Helper()
+	ctx := context.Background()
+	userStore.DeleteUser(ctx, user.ID, 0)
+	err := userStore.CreateUser(ctx, user)
 	if err != nil {
-		log.Fatalf("Error reading config file: %s\n", err)
+		t.Fatalf("Error creating user: %s\n", err)
 	}
 }
 
 func TestGetUsers(t *testing.T) {
+	setupStores(t)
 	ctx := context.Background()
-	var err error
-	client, err = getMongoClient(ctx)
-	if err != nil {
-		t.Fatalf("Error connecting to MongoDB: %s\n", err)
-	}
-	defer client.Disconnect(ctx)
 
 	// Create a user
-	coll := getUsersCollection(client)
 	user := &User{
-		ID:   "testuser",
-		Name: "Alice",
-	}
-	_, err = coll.UpdateOne(
-		ctx,
-		bson.M{"_id": user.ID},
-		bson.M{"$set": user},
-		options.Update().SetUpsert(true),
-	)
-	if err != nil {
-		t.Fatalf("Error creating user: %s\n", err)
+		ID:    "testuser",
+		Name:  "Alice",
+		Scope: []string{scopeUsersRead},
 	}
+	createTestUser(t, user)
 
 	// Get the users
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/api/v1/users", nil)
-	getUsers(w, r)
+	w := send(t, user, "GET", "/api/v1/users", "")
 
 	if w.Code != 200 {
 		t.Errorf("Expected status code 200, got %d", w.Code)
 	}
 
 	users := []User{}
-	err = json.NewDecoder(w.Body).Decode(&users)
+	err := json.NewDecoder(w.Body).Decode(&users)
 	if err != nil {
 		t.Fatalf("Error decoding response: %s\n", err)
 	}
@@ -67,46 +51,30 @@ func TestGetUsers(t *testing.T) {
 		t.Errorf("Expected at least one user, got %d", len(users))
 	}
 
-	coll.DeleteOne(ctx, bson.M{"_id": "testuser"})
+	userStore.DeleteUser(ctx, "testuser", 0)
 }
 
 func TestGetUser(t *testing.T) {
+	setupStores(t)
 	ctx := context.Background()
-	var err error
-	client, err = getMongoClient(ctx)
-	if err != nil {
-		t.Fatalf("Error connecting to MongoDB: %s\n", err)
-	}
-	defer client.Disconnect(ctx)
 
 	// Create a user
-	coll := getUsersCollection(client)
 	user := &User{
-		ID:   "testuser",
-		Name: "Alice",
-	}
-	_, err = coll.UpdateOne(
-		ctx,
-		bson.M{"_id": user.ID},
-		bson.M{"$set": user},
-		options.Update().SetUpsert(true),
-	)
-	if err != nil {
-		t.Fatalf("Error creating user: %s\n", err)
+		ID:    "testuser",
+		Name:  "Alice",
+		Scope: []string{scopeUsersRead},
 	}
+	createTestUser(t, user)
 
 	// Get the user
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/api/v1/users/testuser", nil)
-	r = mux.SetURLVars(r, map[string]string{"userID": "testuser"})
-	getUser(w, r)
+	w := send(t, user, "GET", "/api/v1/users/testuser", "")
 
 	if w.Code != 200 {
 		t.Errorf("Expected status code 200, got %d", w.Code)
 	}
 
 	testUser := &User{}
-	err = json.NewDecoder(w.Body).Decode(testUser)
+	err := json.NewDecoder(w.Body).Decode(testUser)
 	if err != nil {
 		t.Fatalf("Error decoding response: %s\n", err)
 	}
@@ -114,84 +82,59 @@ func TestGetUser(t *testing.T) {
 		t.Errorf("Expected name Alice, got %s", testUser.Name)
 	}
 
-	coll.DeleteOne(ctx, bson.M{"_id": "testuser"})
+	userStore.DeleteUser(ctx, "testuser", 0)
 }
 
 func TestCreateUser(t *testing.T) {
+	setupStores(t)
 	ctx := context.Background()
-	var err error
-	client, err = getMongoClient(ctx)
-	if err != nil {
-		t.Fatalf("Error connecting to MongoDB: %s\n", err)
-	}
-	defer client.Disconnect(ctx)
-
-	coll := getUsersCollection(client)
-	coll.DeleteOne(ctx, bson.M{"_id": "testuser2"})
 
-	// Create the user
-	body := `{"id":"testuser2","name": "Bob"}`
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(body))
-	createUser(w, r)
-
-	if w.Code != 201 {
-		t.Errorf("Expected status code 201, got %d", w.Code)
+	// Create the user, ignoring the client's ID
+	body := `{"id":"testuser2","name": "Bob","username":"bob","password":"secret"}`
+	w := send(t, testAdmin, "POST", "/api/v1/users", body)
+	userID := createdID(t, w)
+	if userID == "" || userID == "testuser2" {
+		t.Errorf("Expected a server-generated ID, got %q", userID)
 	}
 
 	// Check the user
-	user := &User{}
-
-	err = coll.FindOne(ctx, bson.M{"_id": "testuser2"}).Decode(user)
+	user, err := userStore.GetUser(ctx, userID)
 	if err != nil {
 		t.Fatalf("Error finding user: %s\n", err)
 	}
 	if user.Name != "Bob" {
 		t.Errorf("Expected name Bob, got %s", user.Name)
 	}
+	if user.CreatedAt.IsZero() || user.CreatedBy != testAdmin.ID {
+		t.Errorf("Expected createdAt and createdBy to be set, got %+v", user)
+	}
 
-	coll.DeleteOne(ctx, bson.M{"_id": "testuser2"})
+	userStore.DeleteUser(ctx, userID, 0)
 }
 
 func TestUpdateUser(t *testing.T) {
+	setupStores(t)
 	ctx := context.Background()
-	var err error
-	client, err = getMongoClient(ctx)
-	if err != nil {
-		t.Fatalf("Error connecting to MongoDB: %s\n", err)
-	}
-	defer client.Disconnect(ctx)
 
 	// Create a user
-	coll := getUsersCollection(client)
 	user := &User{
-		ID:   "testuser",
-		Name: "Alice",
-	}
-	_, err = coll.UpdateOne(
-		ctx,
-		bson.M{"_id": user.ID},
-		bson.M{"$set": user},
-		options.Update().SetUpsert(true),
-	)
-	if err != nil {
-		t.Fatalf("Error creating user: %s\n", err)
+		ID:       "testuser",
+		Name:     "Alice",
+		Username: "alice",
+		Scope:    []string{scopeUsersRead},
 	}
+	createTestUser(t, user)
 
 	// Update the user
-	body := `{"id":"testuser","name": "Bob"}`
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("PUT", "/api/v1/users/testuser", strings.NewReader(body))
-	r = mux.SetURLVars(r, map[string]string{"userID": "testuser"})
-	updateUser(w, r)
+	body := `{"id":"testuser","name": "Bob","username":"bob"}`
+	w := send(t, testAdmin, "PUT", "/api/v1/users/testuser", body)
 
 	if w.Code != 200 {
 		t.Errorf("Expected status code 200, got %d", w.Code)
 	}
 
 	// Check the user
-	user = &User{}
-	err = coll.FindOne(ctx, bson.M{"_id": "testuser"}).Decode(user)
+	user, err := userStore.GetUser(ctx, "testuser")
 	if err != nil {
 		t.Fatalf("Error finding user: %s\n", err)
 	}
@@ -201,47 +144,206 @@ func TestUpdateUser(t *testing.T) {
 }
 
 func TestDeleteUser(t *testing.T) {
+	setupStores(t)
 	ctx := context.Background()
-	var err error
-	client, err = getMongoClient(ctx)
-	if err != nil {
-		t.Fatalf("Error connecting to MongoDB: %s\n", err)
-	}
-	defer client.Disconnect(ctx)
 
 	// Create a user
-	coll := getUsersCollection(client)
 	user := &User{
-		ID:   "testuser",
-		Name: "Alice",
-	}
-	_, err = coll.UpdateOne(
-		ctx,
-		bson.M{"_id": user.ID},
-		bson.M{"$set": user},
-		options.Update().SetUpsert(true),
-	)
-	if err != nil {
-		t.Fatalf("Error creating user: %s\n", err)
+		ID:    "testuser",
+		Name:  "Alice",
+		Scope: []string{scopeUsersRead},
 	}
+	createTestUser(t, user)
 
 	// Delete the user
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("DELETE", "/api/v1/users/testuser", nil)
-	r = mux.SetURLVars(r, map[string]string{"userID": "testuser"})
-	deleteUser(w, r)
+	w := send(t, testAdmin, "DELETE", "/api/v1/users/testuser", "")
 
 	if w.Code != 204 {
 		t.Errorf("Expected status code 204, got %d", w.Code)
 	}
 
 	// Check the user
-	user = &User{}
-	err = coll.FindOne(ctx, bson.M{"_id": "testuser"}).Decode(user)
+	user, err := userStore.GetUser(ctx, "testuser")
 	if err == nil {
-		t.Fatalf("Error not finding user: %s\n", err)
+		t.Fatalf("Expected user to be deleted, got %v\n", user)
+	}
+}
+
+func TestUserResponsesOmitPassword(t *testing.T) {
+	setupStores(t)
+
+	body := `{"name":"Carol","username":"carol","password":"secret"}`
+	w := send(t, testAdmin, "POST", "/api/v1/users", body)
+	userID := createdID(t, w)
+	if strings.Contains(w.Body.String(), "password") {
+		t.Errorf("Expected no password in create response, got %s", w.Body.String())
+	}
+
+	for _, path := range []string{"/api/v1/users", "/api/v1/users/" + userID} {
+		w = send(t, testAdmin, "GET", path, "")
+		if strings.Contains(w.Body.String(), "password") || strings.Contains(w.Body.String(), "$2a$") {
+			t.Errorf("Expected no password in %s response, got %s", path, w.Body.String())
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	setupStores(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	alice := &User{ID: "alice", Username: "alice", Password: string(hash)}
+	createTestUser(t, alice)
+
+	// The current password must match
+	w := send(t, alice, "PUT", "/api/v1/users/alice/password", `{"currentPassword":"wrong","newPassword":"n3w"}`)
+	if w.Code != 403 {
+		t.Errorf("Expected status code 403, got %d", w.Code)
+	}
+
+	// Only the user can change their own password
+	w = send(t, testAdmin, "PUT", "/api/v1/users/alice/password", `{"currentPassword":"secret","newPassword":"n3w"}`)
+	if w.Code != 403 {
+		t.Errorf("Expected status code 403, got %d", w.Code)
+	}
+
+	w = send(t, alice, "PUT", "/api/v1/users/alice/password", `{"currentPassword":"secret","newPassword":"n3w"}`)
+	if w.Code != 204 {
+		t.Fatalf("Expected status code 204, got %d", w.Code)
+	}
+	decodeTokens(t, send(t, nil, "POST", "/api/v1/login", `{"username":"alice","password":"n3w"}`))
+}
+
+func TestPatchUser(t *testing.T) {
+	setupStores(t)
+	ctx := context.Background()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	createTestUser(t, &User{ID: "alice", Name: "Alice", Username: "alice", Password: string(hash), Scope: []string{scopeTodosRead}})
+	createTestUser(t, testAdmin)
+	writer := &User{ID: "writer", Scope: []string{scopeUsersWrite, scopeTodosRead}}
+
+	// Only the patched field changes
+	w := send(t, writer, "PATCH", "/api/v1/users/alice", `{"name":"Alicia"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	user, _ := userStore.GetUser(ctx, "alice")
+	if user.Name != "Alicia" || user.Username != "alice" || user.Password != string(hash) || len(user.Scope) != 1 {
+		t.Errorf("Expected only the name to change, got %+v", user)
+	}
+
+	// Only users:admin sets other users' passwords, and nobody their own
+	for _, tt := range []struct {
+		caller *User
+		target string
+	}{{writer, "alice"}, {writer, testAdmin.ID}, {&User{ID: "alice", Scope: []string{scopeUsersWrite}}, "alice"}} {
+		w = send(t, tt.caller, "PATCH", "/api/v1/users/"+tt.target, `{"password":"n3w"}`)
+		if w.Code != 403 {
+			t.Errorf("%s setting the password of %s: expected status code 403, got %d", tt.caller.ID, tt.target, w.Code)
+		}
+	}
+	if user, _ := userStore.GetUser(ctx, "alice"); user.Password != string(hash) {
+		t.Errorf("Expected the password to be kept")
+	}
+
+	// Users holding scopes the caller lacks can't be edited, deleted or
+	// logged out
+	for _, tt := range []struct{ method, target string }{
+		{"PATCH", "/api/v1/users/" + testAdmin.ID},
+		{"POST", "/api/v1/users/" + testAdmin.ID + "/logout"},
+		{"DELETE", "/api/v1/users/" + testAdmin.ID + "?cascade=true"},
+	} {
+		if w := send(t, writer, tt.method, tt.target, `{"name":"Mallory"}`); w.Code != 403 {
+			t.Errorf("%s %s: expected status code 403, got %d", tt.method, tt.target, w.Code)
+		}
+	}
+	if _, err := userStore.GetUser(ctx, testAdmin.ID); err != nil {
+		t.Errorf("Expected the admin to be kept: %v", err)
+	}
+	issued := &TodoClaims{ID: testAdmin.ID, RegisteredClaims: jwt.RegisteredClaims{ID: "earlier", IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}}
+	if revoked, _ := tokenStore.IsRevoked(ctx, issued); revoked {
+		t.Errorf("Expected the admin's sessions to be kept")
+	}
+
+	// Passwords are hashed
+	w = send(t, testAdmin, "PATCH", "/api/v1/users/alice", `{"password":"n3w"}`)
+	user, _ = userStore.GetUser(ctx, "alice")
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("n3w")) != nil {
+		t.Errorf("Expected new password to be stored hashed, got %q", user.Password)
+	}
+
+	// A PUT without password or scope keeps them
+	w = send(t, writer, "PUT", "/api/v1/users/alice", `{"name":"Alice","username":"alice"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+	user, _ = userStore.GetUser(ctx, "alice")
+	if user.Password == "" || len(user.Scope) != 1 {
+		t.Errorf("Expected password and scope to be kept, got %+v", user)
+	}
+
+	// Changing scopes needs users:admin, resending them in another order doesn't
+	send(t, testAdmin, "PATCH", "/api/v1/users/alice", `{"scope":["todos:read","users:write"]}`)
+	w = send(t, writer, "PATCH", "/api/v1/users/alice", `{"scope":["users:write","todos:read"]}`)
+	if w.Code != 200 {
+		t.Errorf("Expected reordered scopes to be kept, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, method := range []string{"PUT", "PATCH"} {
+		w = send(t, writer, method, "/api/v1/users/alice", `{"username":"alice","scope":["users:admin"]}`, "Content-Type", "application/json")
+		if w.Code != 403 {
+			t.Errorf("%s: Expected status code 403, got %d", method, w.Code)
+		}
+	}
+	w = send(t, testAdmin, "PATCH", "/api/v1/users/alice", `{"scope":["todos:read","todos:write"]}`)
+	user, _ = userStore.GetUser(ctx, "alice")
+	if len(user.Scope) != 2 {
+		t.Errorf("Expected admin to change scopes, got %v", user.Scope)
+	}
+}
+
+func TestListUsersSearchAndPages(t *testing.T) {
+	setupStores(t)
+	for _, user := range []*User{
+		{ID: "1", Name: "Alice Smith", Username: "asmith", Scope: []string{scopeTodosRead}},
+		{ID: "2", Name: "Bob", Username: "bob"},
+		{ID: "3", Name: "Carol", Username: "alice2", Scope: []string{scopeTodosRead}},
+		{ID: "4", Name: "Dave", Username: "dave"},
+	} {
+		createTestUser(t, user)
+	}
+
+	list := func(path string) (string, *httptest.ResponseRecorder) {
+		w := send(t, testAdmin, "GET", path, "")
+		users := []*UserResponse{}
+		json.NewDecoder(w.Body).Decode(&users)
+		ids := ""
+		for _, user := range users {
+			ids += user.ID
+		}
+		return ids, w
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/users", "3124"},
+		{"/api/v1/users?q=ALI", "31"},
+		{"/api/v1/users?scope=todos:read", "31"},
+		{"/api/v1/users?limit=2", "31"},
+	}
+	for _, tt := range tests {
+		ids, w := list(tt.path)
+		if w.Code != 200 || ids != tt.want {
+			t.Errorf("%s: Expected %s, got %d %s", tt.path, tt.want, w.Code, ids)
+		}
+	}
+
+	_, w := list("/api/v1/users?limit=2")
+	ids, _ := list("/api/v1/users?limit=2&cursor=" + w.Header().Get("X-Next-Cursor"))
+	if ids != "24" {
+		t.Errorf("Expected second page 24, got %s", ids)
 	}
-	if user.Name == "Alice" {
-		t.Errorf("Expected nothing, got %s", user.Name)
+	_, w = list("/api/v1/users?limit=many")
+	if w.Code != 400 {
+		t.Errorf("Expected status code 400, got %d", w.Code)
 	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Tag names are up to 32 letters, digits, '-' and '_', which keeps them
+// usable in comma-separated query parameters.
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}_-]{0,31}$`)
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// knownScopes are the scopes that can be granted to a user.
+var knownScopes = []string{scopeUsersRead, scopeUsersWrite, scopeUsersAdmin, scopeTodosRead, scopeTodosWrite, scopeTodosAdmin}
+
+// validate checks v, a pointer to a struct, against the rules in the
+// validate tags of its fields and returns every violation, named by the
+// field's JSON name. Rules are separated by commas:
+//
+//	required   the field must not be empty
+//	min=N      strings need at least N characters, numbers must be at least N
+//	max=N      strings may have at most N characters, slices N elements,
+//	           numbers must be at most N
+//	maxbytes=N strings may have at most N bytes, for limits like bcrypt's
+//	username   lowercase letters, digits, '.', '_' and '-', not starting
+//	           with punctuation
+//	status     a status of the todo workflow
+//	scope      every element is a known scope
+//	timezone   an IANA time zone name
+//	tag        a tag name, or for slices, every element is one
+//	color      a color like #1e90ff
+//
+// Empty fields pass every rule but required.
+func validate(v interface{}) []FieldError {
+	errs := []FieldError{}
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag := rt.Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		for _, rule := range strings.Split(tag, ",") {
+			fe := checkRule(rv.Field(i), rule)
+			if fe != nil {
+				fe.Field = name
+				errs = append(errs, *fe)
+				break
+			}
+		}
+	}
+	return errs
+}
+
+func checkRule(field reflect.Value, rule string) *FieldError {
+	rule, arg, _ := strings.Cut(rule, "=")
+	if field.IsZero() {
+		if rule == "required" {
+			return &FieldError{Code: "required", Message: "is required"}
+		}
+		return nil
+	}
+
+	switch rule {
+	case "required":
+	case "min", "max":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			panic("validate: bad rule " + rule + "=" + arg)
+		}
+		if field.Kind() == reflect.Int {
+			if rule == "min" && field.Int() < int64(n) {
+				return &FieldError{Code: "too_small", Message: fmt.Sprintf("must be at least %d", n)}
+			}
+			if rule == "max" && field.Int() > int64(n) {
+				return &FieldError{Code: "too_large", Message: fmt.Sprintf("must be at most %d", n)}
+			}
+			break
+		}
+		length, unit := field.Len(), "elements"
+		if field.Kind() == reflect.String {
+			length, unit = utf8.RuneCountInString(field.String()), "characters"
+		}
+		if rule == "min" && length < n {
+			return &FieldError{Code: "too_short", Message: fmt.Sprintf("must have at least %d %s", n, unit)}
+		}
+		if rule == "max" && length > n {
+			return &FieldError{Code: "too_long", Message: fmt.Sprintf("must have at most %d %s", n, unit)}
+		}
+	case "maxbytes":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			panic("validate: bad rule " + rule + "=" + arg)
+		}
+		if len(field.String()) > n {
+			return &FieldError{Code: "too_long", Message: fmt.Sprintf("must have at most %d bytes", n)}
+		}
+	case "username":
+		if !usernamePattern.MatchString(field.String()) {
+			return &FieldError{Code: "invalid_format", Message: "may only contain lowercase letters, digits, '.', '_' and '-'"}
+		}
+	case "status":
+		status := TodoStatus(field.String())
+		if !workflow.Known(status) {
+			return &FieldError{Code: "invalid_status", Message: "unknown status " + string(status)}
+		}
+	case "scope":
+		for _, scope := range field.Interface().([]string) {
+			if !containsString(knownScopes, scope) {
+				return &FieldError{Code: "invalid_scope", Message: "unknown scope " + scope}
+			}
+		}
+	case "timezone":
+		_, err := loadLocation(field.String())
+		if err != nil {
+			return &FieldError{Code: "invalid_timezone", Message: err.Error()}
+		}
+	case "tag":
+		names := []string{}
+		if field.Kind() == reflect.String {
+			names = append(names, field.String())
+		} else {
+			names = field.Interface().([]string)
+		}
+		for _, name := range names {
+			if !tagPattern.MatchString(name) {
+				return &FieldError{Code: "invalid_tag", Message: "tag " + name + " must be up to 32 letters, digits, '-' or '_'"}
+			}
+		}
+	case "color":
+		if !colorPattern.MatchString(field.String()) {
+			return &FieldError{Code: "invalid_color", Message: "must be a color like #1e90ff"}
+		}
+	default:
+		panic("validate: unknown rule " + rule)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkValid validates v and writes a 422 response listing every invalid
+// field, along with extra violations found by the caller, and returns false
+// if there are any.
+func checkValid(w http.ResponseWriter, r *http.Request, v interface{}, extra ...FieldError) bool {
+	errs := append(validate(v), extra...)
+	if len(errs) > 0 {
+		writeError(w, r, validationFailed(errs...))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want []string
+	}{
+		{&UserRequest{Username: "alice"}, nil},
+		{&UserRequest{}, []string{"username:required"}},
+		{&UserRequest{Username: "Al ice", Scope: []string{"todos:read", "root"}}, []string{"username:invalid_format", "scope:invalid_scope"}},
+		{&UserRequest{Username: "al", Name: strings.Repeat("x", 101)}, []string{"name:too_long", "username:too_short"}},
+		{&UserRequest{Username: "_alice"}, []string{"username:invalid_format"}},
+		{&Todo{Title: "Chores", Status: StatusDone}, nil},
+		{&Todo{Status: "archived"}, []string{"title:required", "status:invalid_status"}},
+		{&Todo{Title: strings.Repeat("é", 200)}, nil},
+		{&Todo{Title: strings.Repeat("é", 201)}, []string{"title:too_long"}},
+		{&ChangePasswordRequest{}, []string{"newPassword:required"}},
+		{&ChangePasswordRequest{NewPassword: strings.Repeat("é", 36)}, nil},
+		{&ChangePasswordRequest{NewPassword: strings.Repeat("é", 40)}, []string{"newPassword:too_long"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, fe := range validate(tt.v) {
+			got = append(got, fe.Field+":"+fe.Code)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("validate(%+v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidPayloads(t *testing.T) {
+	setupStores(t)
+	createTestUser(t, testAdmin)
+	createTestUser(t, &User{ID: "bob", Username: "bob"})
+
+	tests := []struct {
+		method, target, body string
+		status               int
+		fields               []string
+	}{
+		{"POST", "/api/v1/todos", `{"title":""}`, 422, []string{"title"}},
+		{"POST", "/api/v1/todos", `{"status":"archived"}`, 422, []string{"title", "status"}},
+		{"POST", "/api/v1/users", `{"name":"Eve","username":"Eve!"}`, 422, []string{"username", "password"}},
+		{"POST", "/api/v1/users", `{"username":"bob","password":"secret"}`, 409, []string{"username"}},
+		{"PUT", "/api/v1/users/" + testAdmin.ID, `{"username":"bob"}`, 409, []string{"username"}},
+		{"PUT", "/api/v1/users/bob", `{"name":"Bob"}`, 422, []string{"username"}},
+		{"POST", "/api/v1/users", `{"username":"eve","password":"` + strings.Repeat("é", 40) + `"}`, 422, []string{"password"}},
+	}
+	for _, tt := range tests {
+		w := send(t, testAdmin, tt.method, tt.target, tt.body)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s %s: expected status code %d, got %d: %s", tt.method, tt.target, tt.body, tt.status, w.Code, w.Body.String())
+			continue
+		}
+		problem := decodeProblem(t, w)
+		got := []string{}
+		for _, fe := range problem.Errors {
+			got = append(got, fe.Field)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.fields, " ") {
+			t.Errorf("%s %s %s: expected errors for %v, got %+v", tt.method, tt.target, tt.body, tt.fields, problem.Errors)
+		}
+	}
+}